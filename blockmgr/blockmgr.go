@@ -0,0 +1,212 @@
+// Package blockmgr resolves the blocks of a library, either proxy files of the block mapping or native block files.
+package blockmgr
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Kind is where the data of a block is stored.
+type Kind string
+
+const (
+	// Native blocks are files in the blocks directory of the data dir.
+	Native Kind = "native"
+	// Proxy blocks are ranges of real files, recorded in the block mapping.
+	Proxy Kind = "proxy"
+)
+
+var (
+	// ErrMissing is returned when a block or the real file it points to does not exist.
+	ErrMissing = errors.New("block is missing")
+	// ErrCorrupt is returned when the data of a block can not be read in full or does not hash to its id.
+	ErrCorrupt = errors.New("block is corrupt")
+	// ErrStale is returned when the real file of a proxy block changed since it was scanned.
+	ErrStale = errors.New("block is stale")
+)
+
+// Block is a resolved block.
+type Block struct {
+	ID   string `json:"id"`
+	Kind Kind   `json:"kind"`
+	// Path is the native block file or the real file of a proxy block.
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	// Mtime is the mtime of the real file when a proxy block was scanned.
+	Mtime int64 `json:"mtime,omitempty"`
+	// ContentID is set when the id of the block is the SHA-1 of its data.
+	ContentID bool `json:"content_id"`
+	// Stale is set when the proxy block was marked stale in the mapping.
+	Stale bool `json:"stale,omitempty"`
+}
+
+// Resolver resolves the blocks of a repo. The block mapping must be open to resolve proxy blocks.
+type Resolver struct {
+	RepoID string
+	// Overlay is the backing directory of an overlay mount, its blocks hide the proxy and native blocks.
+	Overlay string
+	dataDir string
+	roots   *virtualfs.RootResolver
+}
+
+// NewResolver creates a Resolver of the repo in dataDir, the real files of proxy blocks are found with roots.
+// Without roots only native blocks are resolved.
+func NewResolver(dataDir string, repoID string, roots *virtualfs.RootResolver) *Resolver {
+	return &Resolver{RepoID: repoID, dataDir: dataDir, roots: roots}
+}
+
+// NativePath returns the path of the native block file blkID.
+func (r *Resolver) NativePath(blkID string) string {
+	return filepath.Join(r.dataDir, "storage", "blocks", r.RepoID, blkID[:2], blkID[2:])
+}
+
+// Resolve finds the block blkID, first in the overlay directory, then in the block mapping and then in the blocks directory.
+func (r *Resolver) Resolve(blkID string) (*Block, error) {
+	if len(blkID) != 40 {
+		return nil, fmt.Errorf("invalid block id %q", blkID)
+	}
+	if r.Overlay != "" {
+		path := filepath.Join(r.Overlay, blkID[:2], blkID[2:])
+		if info, err := os.Stat(path); err == nil {
+			return &Block{ID: blkID, Kind: Native, Path: path, Size: info.Size(), ContentID: true}, nil
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if r.roots != nil {
+		proxy, err := virtualfs.GetProxy(virtualfs.ProxyPath(r.RepoID, blkID))
+		if err == nil {
+			path, err := r.roots.Resolve(proxy.RealFileId)
+			if err != nil {
+				return nil, fmt.Errorf("%s: real file %d: %w: %v", blkID, proxy.RealFileId, ErrMissing, err)
+			}
+			return &Block{
+				ID:        blkID,
+				Kind:      Proxy,
+				Path:      path,
+				Offset:    proxy.Offset,
+				Size:      proxy.Size,
+				Mtime:     proxy.Mtime,
+				ContentID: proxy.Kind == virtualfs.ProxyContent,
+				Stale:     proxy.Stale,
+			}, nil
+		} else if !errors.Is(err, syscall.ENOENT) {
+			return nil, err
+		}
+	}
+	path := r.NativePath(blkID)
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("%s: %w", blkID, ErrMissing)
+	} else if err != nil {
+		return nil, err
+	}
+	return &Block{ID: blkID, Kind: Native, Path: path, Size: info.Size(), ContentID: true}, nil
+}
+
+// Check checks that the data of the block can be read. With verify the data of content id blocks is hashed.
+func (r *Resolver) Check(b *Block, verify bool) error {
+	info, err := os.Stat(b.Path)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%s: %s: %w", b.ID, b.Path, ErrMissing)
+	} else if err != nil {
+		return err
+	}
+	if info.Size() < b.Offset+b.Size {
+		return fmt.Errorf("%s: %s has %d bytes, the block ends at %d: %w", b.ID, b.Path, info.Size(), b.Offset+b.Size, ErrCorrupt)
+	}
+	if b.Stale {
+		return fmt.Errorf("%s: %s is marked stale: %w", b.ID, b.Path, ErrStale)
+	}
+	if b.Kind == Proxy && info.ModTime().Unix() != b.Mtime {
+		return fmt.Errorf("%s: %s was modified since the scan: %w", b.ID, b.Path, ErrStale)
+	}
+	if !verify || !b.ContentID {
+		return nil
+	}
+	rd, err := r.Open(b)
+	if err != nil {
+		return err
+	}
+	defer rd.Close()
+	hash := sha1.New()
+	if _, err = io.Copy(hash, rd); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(hash.Sum(nil)); sum != b.ID {
+		return fmt.Errorf("%s: %s hashes to %s: %w", b.ID, b.Path, sum, ErrCorrupt)
+	}
+	return nil
+}
+
+type blockReader struct {
+	*io.SectionReader
+	f *os.File
+}
+
+func (r *blockReader) Close() error {
+	return r.f.Close()
+}
+
+// Open opens the data of the block for reading.
+func (r *Resolver) Open(b *Block) (io.ReadCloser, error) {
+	f, err := os.Open(b.Path)
+	if err != nil {
+		return nil, err
+	}
+	return &blockReader{SectionReader: io.NewSectionReader(f, b.Offset, b.Size), f: f}, nil
+}
+
+// MultiReader reads the data of blocks one after the other, a block is opened when it is reached.
+type MultiReader struct {
+	r      *Resolver
+	blocks []*Block
+	cur    io.ReadCloser
+}
+
+// NewMultiReader returns a reader of the data of blocks, e.g. the blocks of a file.
+func (r *Resolver) NewMultiReader(blocks []*Block) *MultiReader {
+	return &MultiReader{r: r, blocks: blocks}
+}
+
+func (m *MultiReader) Read(p []byte) (int, error) {
+	for {
+		if m.cur == nil {
+			if len(m.blocks) == 0 {
+				return 0, io.EOF
+			}
+			rd, err := m.r.Open(m.blocks[0])
+			if err != nil {
+				return 0, err
+			}
+			m.cur, m.blocks = rd, m.blocks[1:]
+		}
+		n, err := m.cur.Read(p)
+		if err == io.EOF {
+			m.cur.Close()
+			m.cur = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (m *MultiReader) Close() error {
+	if m.cur == nil {
+		return nil
+	}
+	err := m.cur.Close()
+	m.cur = nil
+	return err
+}
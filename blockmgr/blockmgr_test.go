@@ -0,0 +1,53 @@
+package blockmgr
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testRepoID = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+
+func TestResolver_Native(t *testing.T) {
+	r := NewResolver(t.TempDir(), testRepoID, nil)
+	data := []byte("hello block")
+	sum := sha1.Sum(data)
+	blkID := hex.EncodeToString(sum[:])
+	if _, err := r.Resolve(blkID); !errors.Is(err, ErrMissing) {
+		t.Fatalf("resolve of a missing block returned %v", err)
+	}
+	path := r.NativePath(blkID)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	b, err := r.Resolve(blkID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Kind != Native || b.Size != int64(len(data)) {
+		t.Fatalf("resolved %+v", b)
+	}
+	if err = r.Check(b, true); err != nil {
+		t.Fatal(err)
+	}
+	all, err := io.ReadAll(r.NewMultiReader([]*Block{b, b}))
+	if err != nil || string(all) != string(data)+string(data) {
+		t.Fatalf("read %q, error %v", all, err)
+	}
+	if err = os.WriteFile(path, []byte("hello blocK"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = r.Check(b, false); err != nil {
+		t.Fatalf("check without verify returned %v", err)
+	}
+	if err = r.Check(b, true); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("check of a changed block returned %v", err)
+	}
+}
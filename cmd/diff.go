@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/commitmgr"
+	"github.com/manx98/local_to_seaf_store/diffmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"github.com/manx98/local_to_seaf_store/utils"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"text/tabwriter"
+)
+
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "list the paths added, deleted, modified and renamed between two commits of a library",
+	Run:   diffCommits,
+}
+var diffDataDir *string
+var diffRepoId *string
+var diffFrom *string
+var diffTo *string
+var diffJson *bool
+
+// DiffReport is the result of diff.
+type DiffReport struct {
+	RepoID    string            `json:"repo_id"`
+	FromID    string            `json:"from_commit_id"`
+	ToID      string            `json:"to_commit_id"`
+	SizeDelta int64             `json:"size_delta"`
+	Changes   []*diffmgr.Change `json:"changes"`
+}
+
+func loadDiffCommit(commitID string) *commitmgr.Commit {
+	if !utils.IsObjectIDValid(commitID) {
+		logger.Fatal("commit is not object id", zap.String("commit", commitID))
+	}
+	commit, err := commitmgr.Load(*diffRepoId, commitID)
+	if err != nil {
+		logger.Fatal("load commit occur error", zap.Error(err), zap.String("commit", commitID))
+	}
+	if commit.RepoID != *diffRepoId {
+		logger.Fatal("commit belongs to another repo", zap.String("commit", commitID), zap.String("commit_repo_id", commit.RepoID))
+	}
+	return commit
+}
+
+func diffCommits(cmd *cobra.Command, args []string) {
+	if *diffJson {
+		logger.SetLogWriteSyncer(zapcore.Lock(os.Stderr))
+	}
+	if !utils.IsValidUUID(*diffRepoId) {
+		logger.Fatal("repo_id is not uuid", zap.String("repo_id", *diffRepoId))
+	}
+	// Nothing is written by diff.
+	commitmgr.InitDryRun(*diffDataDir)
+	fsmgr.InitDryRun(*diffDataDir)
+	from := loadDiffCommit(*diffFrom)
+	to := loadDiffCommit(*diffTo)
+	changes, err := diffmgr.Diff(*diffRepoId, from.RootID, to.RootID)
+	if err != nil {
+		logger.Fatal("diff commits occur error", zap.Error(err))
+	}
+	report := &DiffReport{RepoID: *diffRepoId, FromID: from.CommitID, ToID: to.CommitID, Changes: changes}
+	for _, c := range changes {
+		if !c.Dir {
+			report.SizeDelta += c.SizeDelta
+		}
+	}
+	if *diffJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = writeChanges(os.Stdout, changes)
+	}
+	if err != nil {
+		logger.Fatal("write diff occur error", zap.Error(err))
+	}
+}
+
+var changeLetters = map[diffmgr.Status]string{diffmgr.Added: "A", diffmgr.Deleted: "D", diffmgr.Modified: "M", diffmgr.Renamed: "R"}
+
+// writeChanges prints one change per line, A, D, M or R, the path and the size delta, and a total line.
+func writeChanges(w io.Writer, changes []*diffmgr.Change) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	var delta int64
+	counts := make(map[diffmgr.Status]int)
+	for _, c := range changes {
+		counts[c.Status]++
+		p, suffix := c.Path, ""
+		if c.Dir {
+			suffix = "/"
+		} else {
+			delta += c.SizeDelta
+		}
+		p += suffix
+		if c.Status == diffmgr.Renamed {
+			p = c.OldPath + suffix + " -> " + p
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", changeLetters[c.Status], formatSizeDelta(c.SizeDelta), p)
+	}
+	fmt.Fprintf(tw, "%d added, %d deleted, %d modified, %d renamed, %s\n",
+		counts[diffmgr.Added], counts[diffmgr.Deleted], counts[diffmgr.Modified], counts[diffmgr.Renamed], formatSizeDelta(delta))
+	return tw.Flush()
+}
+
+// formatSizeDelta formats a size change with its sign, e.g. +1.5G.
+func formatSizeDelta(n int64) string {
+	if n < 0 {
+		return "-" + formatSize(-n)
+	}
+	return "+" + formatSize(n)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/blockmgr"
+	"github.com/manx98/local_to_seaf_store/commitmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"github.com/manx98/local_to_seaf_store/utils"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "rebuild the files of a commit tree into a directory, or a tar stream on stdout",
+	Run:   exportTree,
+}
+var exportDataDir *string
+var exportRepoId *string
+var exportCommitId *string
+var exportPath *string
+var exportOut *string
+var exportPathPrefix *string
+var exportRoots *string
+var exportVerifyBlocks *bool
+var exportOverlay *string
+
+// exportSink receives the entries of an export, a directory before its entries.
+// Names are relative to the exported path and use slashes, the exported directory itself is ".".
+type exportSink interface {
+	Dir(name string, dirent *fsmgr.SeafDirent) error
+	File(name string, dirent *fsmgr.SeafDirent, size int64, data io.Reader) error
+	Close() error
+}
+
+func filePerm(dirent *fsmgr.SeafDirent) os.FileMode {
+	if perm := os.FileMode(dirent.Mode & 0777); perm != 0 {
+		return perm
+	}
+	return 0644
+}
+
+// dirSink writes the entries below a local directory.
+type dirSink struct {
+	root string
+	// dirs are set their mtime on Close, after their entries are written.
+	dirs []dirMtime
+}
+
+type dirMtime struct {
+	path  string
+	mtime time.Time
+}
+
+func (s *dirSink) Dir(name string, dirent *fsmgr.SeafDirent) error {
+	p := filepath.Join(s.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(p, 0755); err != nil {
+		return err
+	}
+	if dirent.Mtime != 0 {
+		s.dirs = append(s.dirs, dirMtime{path: p, mtime: time.Unix(dirent.Mtime, 0)})
+	}
+	return nil
+}
+
+func (s *dirSink) File(name string, dirent *fsmgr.SeafDirent, size int64, data io.Reader) error {
+	p := filepath.Join(s.root, filepath.FromSlash(name))
+	f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, filePerm(dirent))
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(f, data)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err == nil && n != size {
+		err = fmt.Errorf("read %d bytes of %d", n, size)
+	}
+	if err != nil {
+		return err
+	}
+	mtime := time.Unix(dirent.Mtime, 0)
+	return os.Chtimes(p, mtime, mtime)
+}
+
+func (s *dirSink) Close() error {
+	for i := len(s.dirs) - 1; i >= 0; i-- {
+		if err := os.Chtimes(s.dirs[i].path, s.dirs[i].mtime, s.dirs[i].mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tarSink writes the entries as a POSIX tar stream.
+type tarSink struct {
+	tw *tar.Writer
+}
+
+func (s *tarSink) Dir(name string, dirent *fsmgr.SeafDirent) error {
+	if name == "." {
+		return nil
+	}
+	return s.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  time.Unix(dirent.Mtime, 0),
+		Format:   tar.FormatPAX,
+	})
+}
+
+func (s *tarSink) File(name string, dirent *fsmgr.SeafDirent, size int64, data io.Reader) error {
+	err := s.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(filePerm(dirent)),
+		Size:     size,
+		ModTime:  time.Unix(dirent.Mtime, 0),
+		Format:   tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(s.tw, data)
+	return err
+}
+
+func (s *tarSink) Close() error {
+	return s.tw.Close()
+}
+
+// exporter rebuilds the files of a tree from their blocks.
+type exporter struct {
+	repoID string
+	blocks *blockmgr.Resolver
+	verify bool
+	sink   exportSink
+	files  int64
+	dirs   int64
+	bytes  int64
+	failed int
+}
+
+// fail records an entry that could not be exported, the export goes on with the next one.
+func (e *exporter) fail(name string, err error) {
+	e.failed++
+	logger.Error("export entry occur error", zap.String("path", name), zap.Error(err))
+}
+
+// openFile resolves and checks every block of the file before any of its data is written.
+func (e *exporter) openFile(fileID string) (*blockmgr.MultiReader, int64, error) {
+	file, err := fsmgr.GetSeafile(e.repoID, fileID)
+	if err != nil {
+		return nil, 0, err
+	}
+	blocks := make([]*blockmgr.Block, 0, len(file.BlkIDs))
+	var size int64
+	for _, blkID := range file.BlkIDs {
+		b, err := e.blocks.Resolve(blkID)
+		if err == nil {
+			err = e.blocks.Check(b, e.verify)
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		blocks = append(blocks, b)
+		size += b.Size
+	}
+	if size != int64(file.FileSize) {
+		return nil, 0, fmt.Errorf("blocks of %s have %d bytes, the file has %d: %w", fileID, size, file.FileSize, blockmgr.ErrCorrupt)
+	}
+	return e.blocks.NewMultiReader(blocks), size, nil
+}
+
+func (e *exporter) file(name string, dirent *fsmgr.SeafDirent) error {
+	data, size, err := e.openFile(dirent.ID)
+	if err != nil {
+		e.fail(name, err)
+		return nil
+	}
+	defer data.Close()
+	if err = e.sink.File(name, dirent, size, data); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	e.files++
+	e.bytes += size
+	return nil
+}
+
+func (e *exporter) dir(name string, dirent *fsmgr.SeafDirent) error {
+	if _, err := fsmgr.GetSeafdir(e.repoID, dirent.ID); err != nil {
+		e.fail(name, err)
+		return fsmgr.SkipDir
+	}
+	if err := e.sink.Dir(name, dirent); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	e.dirs++
+	return nil
+}
+
+// run exports the entry top, a directory is exported with all its entries.
+func (e *exporter) run(top *fsmgr.SeafDirent) error {
+	if !fsmgr.IsDir(top.Mode) {
+		return e.file(top.Name, top)
+	}
+	if err := e.dir(".", top); err != nil {
+		if err == fsmgr.SkipDir {
+			return nil
+		}
+		return err
+	}
+	return fsmgr.Walk(e.repoID, top.ID, func(entryPath string, dirent *fsmgr.SeafDirent) error {
+		name := strings.TrimPrefix(entryPath, "/")
+		// A broken or forged name such as ".." or "a/../../x" must not lead out of the output.
+		if err := utils.CheckFileName(dirent.Name); err != nil {
+			e.fail(path.Join(path.Dir(entryPath), fmt.Sprintf("%q", dirent.Name)), err)
+			if fsmgr.IsDir(dirent.Mode) {
+				return fsmgr.SkipDir
+			}
+			return nil
+		}
+		if fsmgr.IsDir(dirent.Mode) {
+			return e.dir(name, dirent)
+		}
+		return e.file(name, dirent)
+	})
+}
+
+func exportTree(cmd *cobra.Command, args []string) {
+	toStdout := *exportOut == "-"
+	if toStdout {
+		// Keep stdout for the tar stream.
+		logger.SetLogWriteSyncer(zapcore.Lock(os.Stderr))
+	}
+	if !utils.IsValidUUID(*exportRepoId) {
+		logger.Fatal("repo_id is not uuid", zap.String("repo_id", *exportRepoId))
+	}
+	if !utils.IsObjectIDValid(*exportCommitId) {
+		logger.Fatal("commit is not object id", zap.String("commit", *exportCommitId))
+	}
+	topPath := path.Clean("/" + *exportPath)
+	// Nothing is written to the data dir by export.
+	commitmgr.InitDryRun(*exportDataDir)
+	fsmgr.InitDryRun(*exportDataDir)
+	blocks := openBlockResolver(*exportDataDir, *exportRepoId, *exportPathPrefix, *exportRoots, *exportOverlay)
+	defer virtualfs.Close()
+	commit, err := commitmgr.Load(*exportRepoId, *exportCommitId)
+	if err != nil {
+		logger.Fatal("load commit occur error", zap.Error(err), zap.String("commit", *exportCommitId))
+	}
+	if commit.RepoID != *exportRepoId {
+		logger.Fatal("commit belongs to another repo", zap.String("commit_repo_id", commit.RepoID))
+	}
+	top, err := fsmgr.GetDirent(*exportRepoId, commit.RootID, topPath)
+	if err != nil {
+		logger.Fatal("find export path occur error", zap.Error(err), zap.String("path", topPath))
+	}
+	var sink exportSink
+	if toStdout {
+		sink = &tarSink{tw: tar.NewWriter(os.Stdout)}
+	} else {
+		if err = os.MkdirAll(*exportOut, 0755); err != nil {
+			logger.Fatal("create output directory occur error", zap.Error(err))
+		}
+		sink = &dirSink{root: *exportOut}
+	}
+	e := &exporter{repoID: *exportRepoId, blocks: blocks, verify: *exportVerifyBlocks, sink: sink}
+	if err = e.run(top); err == nil {
+		err = sink.Close()
+	}
+	if err != nil {
+		logger.Fatal("export occur error", zap.Error(err))
+	}
+	logger.Info("export finished", zap.String("path", topPath), zap.Int64("files", e.files), zap.Int64("dirs", e.dirs),
+		zap.Int64("bytes", e.bytes), zap.Int("failed", e.failed))
+	if e.failed > 0 {
+		virtualfs.Close()
+		logger.Fatal("some entries could not be exported", zap.Int("failed", e.failed))
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/manx98/local_to_seaf_store/blockmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const exportTestRepoID = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+
+// makeExportTree saves a tree of native blocks:
+//
+//	/sub/a.txt   "hello"
+//	/sub/big.bin three blocks
+//	/sub/../evil a file with a forged name
+//	/bad.txt     a file whose size does not match its blocks
+//	/..          a file with a forged name
+func makeExportTree(t *testing.T) (blocks *blockmgr.Resolver, rootID string) {
+	dataDir := t.TempDir()
+	fsmgr.Init(dataDir)
+	blocks = blockmgr.NewResolver(dataDir, exportTestRepoID, nil)
+	saveFile := func(size int64, data ...string) string {
+		var ids []string
+		for _, d := range data {
+			sum := sha1.Sum([]byte(d))
+			id := hex.EncodeToString(sum[:])
+			path := blocks.NativePath(id)
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(d), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, id)
+		}
+		file, err := fsmgr.NewSeafile(1, size, ids)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fsmgr.SaveSeafile(exportTestRepoID, file); err != nil {
+			t.Fatal(err)
+		}
+		return file.FileID
+	}
+	saveDir := func(entries ...*fsmgr.SeafDirent) string {
+		sort.Sort(fsmgr.Dirents(entries))
+		dir, err := fsmgr.NewSeafdir(1, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fsmgr.SaveSeafdir(exportTestRepoID, dir); err != nil {
+			t.Fatal(err)
+		}
+		return dir.DirID
+	}
+	sub := saveDir(
+		fsmgr.NewDirent(saveFile(5, "hello"), "a.txt", modeFile, 1500000000, "me@qq.com", 5),
+		fsmgr.NewDirent(saveFile(9, "one", "two", "six"), "big.bin", modeFile, 1500000001, "me@qq.com", 9),
+		fsmgr.NewDirent(saveFile(4, "evil"), "../evil", modeFile, 1500000003, "me@qq.com", 4),
+	)
+	rootID = saveDir(
+		fsmgr.NewDirent(sub, "sub", modeDir, 1600000000, "", 0),
+		fsmgr.NewDirent(saveFile(6, "short"), "bad.txt", modeFile, 1500000002, "me@qq.com", 6),
+		fsmgr.NewDirent(saveFile(4, "evil"), "..", modeFile, 1500000003, "me@qq.com", 4),
+	)
+	return blocks, rootID
+}
+
+func TestExport_Dir(t *testing.T) {
+	blocks, rootID := makeExportTree(t)
+	out := filepath.Join(t.TempDir(), "out")
+	sink := &dirSink{root: out}
+	e := &exporter{repoID: exportTestRepoID, blocks: blocks, verify: true, sink: sink}
+	err := e.run(&fsmgr.SeafDirent{ID: rootID, Mode: modeDir})
+	if err == nil {
+		err = sink.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.files != 2 || e.dirs != 2 || e.bytes != 14 || e.failed != 3 {
+		t.Errorf("exported %d files %d dirs %d bytes, %d failed", e.files, e.dirs, e.bytes, e.failed)
+	}
+	for name, want := range map[string]string{"sub/a.txt": "hello", "sub/big.bin": "onetwosix"} {
+		data, err := os.ReadFile(filepath.Join(out, name))
+		if err != nil || string(data) != want {
+			t.Errorf("%s = %q, %v, want %q", name, data, err, want)
+		}
+	}
+	for name, want := range map[string]int64{"sub/a.txt": 1500000000, "sub/big.bin": 1500000001, "sub": 1600000000} {
+		if info, err := os.Stat(filepath.Join(out, name)); err != nil || info.ModTime().Unix() != want {
+			t.Errorf("mtime of %s = %v, %v, want %d", name, info.ModTime(), err, want)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(out, "bad.txt")); !os.IsNotExist(err) {
+		t.Errorf("file with a size mismatch was exported: %v", err)
+	}
+	// The forged names must not write anywhere.
+	if entries, _ := os.ReadDir(filepath.Dir(out)); len(entries) != 1 {
+		t.Errorf("export wrote outside of the output: %v", entries)
+	}
+	if _, err = os.Stat(filepath.Join(out, "evil")); !os.IsNotExist(err) {
+		t.Errorf("file with a forged name was exported: %v", err)
+	}
+}
+
+func TestExport_SubPathTar(t *testing.T) {
+	blocks, rootID := makeExportTree(t)
+	top, err := fsmgr.GetDirent(exportTestRepoID, rootID, "/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	sink := &tarSink{tw: tar.NewWriter(&buf)}
+	e := &exporter{repoID: exportTestRepoID, blocks: blocks, sink: sink}
+	if err = e.run(top); err == nil {
+		err = sink.Close()
+	}
+	if err != nil || e.failed != 1 {
+		t.Fatalf("export of /sub: %v, %d failed", err, e.failed)
+	}
+	var got []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, hdr.Name+"="+string(data))
+		if hdr.Name == "a.txt" && !hdr.ModTime.Equal(time.Unix(1500000000, 0)) {
+			t.Errorf("mtime of a.txt = %v", hdr.ModTime)
+		}
+	}
+	if want := "big.bin=onetwosix,a.txt=hello"; strings.Join(got, ",") != want {
+		t.Errorf("tar entries %v, want %s", got, want)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/blockmgr"
+	"github.com/manx98/local_to_seaf_store/commitmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"github.com/manx98/local_to_seaf_store/utils"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+)
+
+var fsckCmd = &cobra.Command{
+	Use:   "fsck",
+	Short: "verify that the tree of a commit is complete and every block resolves",
+	Run:   fsckFs,
+}
+var fsckDataDir *string
+var fsckRepoId *string
+var fsckCommitId *string
+var fsckPathPrefix *string
+var fsckRoots *string
+var fsckJson *bool
+var fsckVerifyBlocks *bool
+var fsckOverlay *string
+
+// Kinds of FsckProblem.
+const (
+	problemMissing = "missing"
+	problemCorrupt = "corrupt"
+	problemStale   = "stale"
+	problemError   = "error"
+)
+
+// FsckProblem is an object of the tree that is not usable.
+type FsckProblem struct {
+	Kind string `json:"kind"`
+	// Object is commit, dir, file or block.
+	Object string `json:"object"`
+	ID     string `json:"id"`
+	// Path is the path in the library of the first entry that uses the object.
+	Path   string `json:"path"`
+	Detail string `json:"detail"`
+}
+
+// FsckReport is the result of fsck.
+type FsckReport struct {
+	RepoID       string        `json:"repo_id"`
+	CommitID     string        `json:"commit_id"`
+	Dirs         int64         `json:"dirs"`
+	Files        int64         `json:"files"`
+	Blocks       int64         `json:"blocks"`
+	ProxyBlocks  int64         `json:"proxy_blocks"`
+	NativeBlocks int64         `json:"native_blocks"`
+	Problems     []FsckProblem `json:"problems"`
+}
+
+func (r *FsckReport) problem(object string, id string, path string, err error) {
+	kind := problemError
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, blockmgr.ErrMissing):
+		kind = problemMissing
+	case errors.Is(err, fsmgr.ErrObjectCorrupt), errors.Is(err, blockmgr.ErrCorrupt):
+		kind = problemCorrupt
+	case errors.Is(err, blockmgr.ErrStale):
+		kind = problemStale
+	}
+	r.Problems = append(r.Problems, FsckProblem{Kind: kind, Object: object, ID: id, Path: path, Detail: err.Error()})
+}
+
+func (r *FsckReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Commit:\t%s\n", r.CommitID)
+	fmt.Fprintf(tw, "Directories:\t%d\n", r.Dirs)
+	fmt.Fprintf(tw, "Files:\t%d\n", r.Files)
+	fmt.Fprintf(tw, "Blocks:\t%d (%d proxy, %d native)\n", r.Blocks, r.ProxyBlocks, r.NativeBlocks)
+	fmt.Fprintf(tw, "Problems:\t%d\n", len(r.Problems))
+	for _, p := range r.Problems {
+		fmt.Fprintf(tw, "%s %s\t%s\t%s\t%s\n", p.Kind, p.Object, p.ID, p.Path, p.Detail)
+	}
+	return tw.Flush()
+}
+
+// fsck checks the objects of the tree of commit and the blocks of its files.
+type fsck struct {
+	repoID  string
+	blocks  *blockmgr.Resolver
+	verify  bool
+	report  *FsckReport
+	checked map[string]bool
+}
+
+func (c *fsck) checkBlock(filePath string, blkID string) {
+	if c.checked[blkID] {
+		return
+	}
+	c.checked[blkID] = true
+	c.report.Blocks++
+	b, err := c.blocks.Resolve(blkID)
+	if err == nil {
+		if b.Kind == blockmgr.Proxy {
+			c.report.ProxyBlocks++
+		} else {
+			c.report.NativeBlocks++
+		}
+		err = c.blocks.Check(b, c.verify)
+	}
+	if err != nil {
+		c.report.problem("block", blkID, filePath, err)
+	}
+}
+
+func (c *fsck) checkFile(filePath string, fileID string) {
+	c.report.Files++
+	if c.checked[fileID] {
+		return
+	}
+	c.checked[fileID] = true
+	if err := fsmgr.VerifyObject(c.repoID, fileID); err != nil {
+		c.report.problem("file", fileID, filePath, err)
+		return
+	}
+	file, err := fsmgr.GetSeafile(c.repoID, fileID)
+	if err != nil {
+		c.report.problem("file", fileID, filePath, err)
+		return
+	}
+	for _, blkID := range file.BlkIDs {
+		c.checkBlock(filePath, blkID)
+	}
+}
+
+// checkDir verifies the dir object and reports whether its entries can be read.
+func (c *fsck) checkDir(dirPath string, dirID string) bool {
+	c.report.Dirs++
+	if err := fsmgr.VerifyObject(c.repoID, dirID); err != nil {
+		c.report.problem("dir", dirID, dirPath, err)
+		return false
+	}
+	return true
+}
+
+func (c *fsck) run(rootID string) error {
+	if !c.checkDir("/", rootID) {
+		return nil
+	}
+	return fsmgr.Walk(c.repoID, rootID, func(entryPath string, dirent *fsmgr.SeafDirent) error {
+		if fsmgr.IsDir(dirent.Mode) {
+			// A directory is read once, it is the same tree wherever it appears.
+			if c.checked[dirent.ID] || !c.checkDir(entryPath, dirent.ID) {
+				return fsmgr.SkipDir
+			}
+			c.checked[dirent.ID] = true
+			return nil
+		}
+		c.checkFile(entryPath, dirent.ID)
+		return nil
+	})
+}
+
+// openBlockResolver opens the block mapping of dataDir read-only and returns a resolver of the blocks of the repo.
+// Without a block mapping only native blocks are resolved.
+// Blocks in the backing directory of an overlay mount are found first.
+func openBlockResolver(dataDir string, repoID string, pathPrefix string, rootsFile string, overlay string) *blockmgr.Resolver {
+	dbFile := filepath.Join(dataDir, "blocks_mapping.db")
+	if _, err := os.Stat(dbFile); err != nil {
+		r := blockmgr.NewResolver(dataDir, repoID, nil)
+		r.Overlay = overlay
+		return r
+	}
+	if err := virtualfs.InitVirtualFs(dbFile, true); err != nil {
+		logger.Fatal("init virtual fs occur error", zap.Error(err))
+	}
+	rootPaths := map[string]string{}
+	if rootsFile != "" {
+		var err error
+		if rootPaths, err = virtualfs.LoadRootsConfig(rootsFile); err != nil {
+			logger.Fatal("load roots config occur error", zap.Error(err))
+		}
+	}
+	r := blockmgr.NewResolver(dataDir, repoID, virtualfs.NewRootResolver(pathPrefix, rootPaths))
+	r.Overlay = overlay
+	return r
+}
+
+func fsckFs(cmd *cobra.Command, args []string) {
+	if *fsckJson {
+		logger.SetLogWriteSyncer(zapcore.Lock(os.Stderr))
+	}
+	if !utils.IsValidUUID(*fsckRepoId) {
+		logger.Fatal("repo_id is not uuid", zap.String("repo_id", *fsckRepoId))
+	}
+	if !utils.IsObjectIDValid(*fsckCommitId) {
+		logger.Fatal("commit is not object id", zap.String("commit", *fsckCommitId))
+	}
+	// Nothing is written by fsck.
+	commitmgr.InitDryRun(*fsckDataDir)
+	fsmgr.InitDryRun(*fsckDataDir)
+	report := &FsckReport{RepoID: *fsckRepoId, CommitID: *fsckCommitId}
+	c := &fsck{
+		repoID:  *fsckRepoId,
+		blocks:  openBlockResolver(*fsckDataDir, *fsckRepoId, *fsckPathPrefix, *fsckRoots, *fsckOverlay),
+		verify:  *fsckVerifyBlocks,
+		report:  report,
+		checked: make(map[string]bool),
+	}
+	commit, err := commitmgr.Load(*fsckRepoId, *fsckCommitId)
+	if err == nil && commit.RepoID != *fsckRepoId {
+		err = fmt.Errorf("commit belongs to repo %s", commit.RepoID)
+	}
+	if err != nil {
+		report.problem("commit", *fsckCommitId, "", err)
+	} else if err = c.run(commit.RootID); err != nil {
+		logger.Fatal("walk commit tree occur error", zap.Error(err))
+	}
+	if *fsckJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(report)
+	} else {
+		err = report.WriteText(os.Stdout)
+	}
+	if err != nil {
+		logger.Fatal("write fsck report occur error", zap.Error(err))
+	}
+	if len(report.Problems) > 0 {
+		virtualfs.Close()
+		logger.Fatal("fsck found problems", zap.Int("problems", len(report.Problems)))
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"github.com/manx98/local_to_seaf_store/blockmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFsck_Classify(t *testing.T) {
+	root := t.TempDir()
+	for name, size := range map[string]int{"ok": 3000, "stale": 1000, "short": 3000} {
+		if err := os.WriteFile(filepath.Join(root, name), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dataDir := initScanTest(t)
+	sc := DirScanner{Workers: 1}
+	scanId, err := sc.Scan(context.Background(), root, *scanRepoId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The proxies of a modified and of a truncated file.
+	if err = os.Chtimes(filepath.Join(root, "stale"), time.Now(), time.Unix(1500000000, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(filepath.Join(root, "short"), 100); err != nil {
+		t.Fatal(err)
+	}
+	blocks := blockmgr.NewResolver(dataDir, *scanRepoId, virtualfs.NewRootResolver(root, nil))
+	saveFile := func(data string) string {
+		sum := sha1.Sum([]byte(data))
+		blkId := hex.EncodeToString(sum[:])
+		if err := os.MkdirAll(filepath.Dir(blocks.NativePath(blkId)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(blocks.NativePath(blkId), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		file, err := fsmgr.NewSeafile(1, int64(len(data)), []string{blkId})
+		if err == nil {
+			err = fsmgr.SaveSeafile(*scanRepoId, file)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		return file.FileID
+	}
+	corruptId := saveFile("corrupt")
+	object := filepath.Join(dataDir, "storage", "fs", *scanRepoId, corruptId[:2], corruptId[2:])
+	if err = os.WriteFile(object, []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	entries := []*fsmgr.SeafDirent{
+		fsmgr.NewDirent(scanId, "scan", modeDir, 1600000000, "", 0),
+		fsmgr.NewDirent(saveFile("native"), "native", modeFile, 1600000000, *creator, 6),
+		fsmgr.NewDirent(strings.Repeat("e", 40), "missing", modeFile, 1600000000, *creator, 1),
+		fsmgr.NewDirent(corruptId, "corrupt", modeFile, 1600000000, *creator, 7),
+	}
+	sort.Sort(fsmgr.Dirents(entries))
+	top, err := fsmgr.NewSeafdir(1, entries)
+	if err == nil {
+		err = fsmgr.SaveSeafdir(*scanRepoId, top)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := &FsckReport{}
+	c := &fsck{repoID: *scanRepoId, blocks: blocks, verify: true, report: report, checked: make(map[string]bool)}
+	if err = c.run(top.DirID); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, p := range report.Problems {
+		got = append(got, p.Kind+" "+p.Object+" "+p.Path)
+	}
+	sort.Strings(got)
+	want := "corrupt block /scan/short,corrupt block /scan/short,corrupt block /scan/short,corrupt file /corrupt,missing file /missing,stale block /scan/stale"
+	if strings.Join(got, ",") != want {
+		t.Errorf("problems %v, want %s", got, want)
+	}
+	if report.Files != 6 || report.Dirs != 2 || report.ProxyBlocks != 7 || report.NativeBlocks != 1 {
+		t.Errorf("checked %d files, %d dirs, %d proxy and %d native blocks", report.Files, report.Dirs, report.ProxyBlocks, report.NativeBlocks)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/commitmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"github.com/manx98/local_to_seaf_store/seafdb"
+	"github.com/manx98/local_to_seaf_store/utils"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"time"
+)
+
+var logCmd = &cobra.Command{
+	Use:   "log",
+	Short: "list the commit history of a library, newest first",
+	Run:   logHistory,
+}
+var logDataDir *string
+var logRepoId *string
+var logFrom *string
+var logMaxCount *int
+var logStats *bool
+var logJson *bool
+var logSeafileDB *string
+var logMysqlDSN *string
+var logSeafileConf *string
+
+// LogEntry is a commit as printed by log.
+type LogEntry struct {
+	CommitID       string `json:"commit_id"`
+	ParentID       string `json:"parent_id,omitempty"`
+	SecondParentID string `json:"second_parent_id,omitempty"`
+	Creator        string `json:"creator"`
+	Ctime          int64  `json:"ctime"`
+	Description    string `json:"description"`
+	RootID         string `json:"root_id"`
+	// Scan is set for the commits saved by scan.
+	Scan bool `json:"scan"`
+	// Files and Bytes are counted with --stats.
+	Files *int64 `json:"files,omitempty"`
+	Bytes *int64 `json:"bytes,omitempty"`
+}
+
+func (e *LogEntry) WriteText(w io.Writer) error {
+	mark := ""
+	if e.Scan {
+		mark = " (scan)"
+	}
+	fmt.Fprintf(w, "commit %s%s\n", e.CommitID, mark)
+	if e.SecondParentID != "" {
+		fmt.Fprintf(w, "Merge:   %s %s\n", e.ParentID, e.SecondParentID)
+	}
+	fmt.Fprintf(w, "Creator: %s\n", e.Creator)
+	fmt.Fprintf(w, "Date:    %s\n", time.Unix(e.Ctime, 0).Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Root:    %s\n", e.RootID)
+	if e.Files != nil {
+		fmt.Fprintf(w, "Files:   %d, %s\n", *e.Files, formatSize(*e.Bytes))
+	}
+	_, err := fmt.Fprintf(w, "\n    %s\n\n", e.Description)
+	return err
+}
+
+// treeStats counts the files of commit trees, a root shared by several commits is walked once.
+type treeStats struct {
+	repoID string
+	roots  map[string][2]int64
+}
+
+func (s *treeStats) get(rootID string) (files int64, size int64, err error) {
+	if stats, ok := s.roots[rootID]; ok {
+		return stats[0], stats[1], nil
+	}
+	if size, files, err = fsmgr.GetTreeStats(s.repoID, rootID); err != nil {
+		return 0, 0, err
+	}
+	s.roots[rootID] = [2]int64{files, size}
+	return files, size, nil
+}
+
+func logHistory(cmd *cobra.Command, args []string) {
+	if *logJson {
+		logger.SetLogWriteSyncer(zapcore.Lock(os.Stderr))
+	}
+	if !utils.IsValidUUID(*logRepoId) {
+		logger.Fatal("repo_id is not uuid", zap.String("repo_id", *logRepoId))
+	}
+	from := *logFrom
+	if from == "HEAD" {
+		db := openSeafileDB(*logDataDir, *logSeafileDB, *logMysqlDSN, *logSeafileConf)
+		head, err := db.GetBranch(context.Background(), *logRepoId, seafdb.MasterBranch)
+		db.Close()
+		if err != nil {
+			logger.Fatal("get branch head occur error", zap.Error(err), zap.String("repo_id", *logRepoId))
+		}
+		from = head
+	} else if !utils.IsObjectIDValid(from) {
+		logger.Fatal("from is not HEAD or a commit id", zap.String("from", from))
+	}
+	// Nothing is written by log.
+	commitmgr.InitDryRun(*logDataDir)
+	fsmgr.InitDryRun(*logDataDir)
+	stats := &treeStats{repoID: *logRepoId, roots: make(map[string][2]int64)}
+	entries := make([]*LogEntry, 0)
+	err := commitmgr.WalkHistory(*logRepoId, []string{from}, func(commit *commitmgr.Commit) error {
+		if *logMaxCount > 0 && len(entries) == *logMaxCount {
+			return commitmgr.StopWalk
+		}
+		entry := &LogEntry{
+			CommitID:       commit.CommitID,
+			ParentID:       commit.ParentID.String,
+			SecondParentID: commit.SecondParentID.String,
+			Creator:        commit.CreatorName,
+			Ctime:          commit.Ctime,
+			Description:    commit.Desc,
+			RootID:         commit.RootID,
+			Scan:           commit.Desc == scanCommitDesc,
+		}
+		if *logStats {
+			files, size, err := stats.get(commit.RootID)
+			if err != nil {
+				return fmt.Errorf("count files of commit %s: %w", commit.CommitID, err)
+			}
+			entry.Files, entry.Bytes = &files, &size
+		}
+		entries = append(entries, entry)
+		if *logJson {
+			return nil
+		}
+		return entry.WriteText(os.Stdout)
+	})
+	if err != nil {
+		logger.Fatal("walk commit history occur error", zap.Error(err))
+	}
+	if *logJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err = enc.Encode(entries); err != nil {
+			logger.Fatal("write commit history occur error", zap.Error(err))
+		}
+	}
+}
@@ -6,19 +6,30 @@ import (
 	_ "bazil.org/fuse/fs/fstestutil"
 	"context"
 	"errors"
+	"fmt"
+	"github.com/google/uuid"
 	"github.com/manx98/local_to_seaf_store/commitmgr"
+	"github.com/manx98/local_to_seaf_store/diffmgr"
+	"github.com/manx98/local_to_seaf_store/filter"
 	"github.com/manx98/local_to_seaf_store/fsmgr"
 	"github.com/manx98/local_to_seaf_store/logger"
+	"github.com/manx98/local_to_seaf_store/mergemgr"
+	"github.com/manx98/local_to_seaf_store/seafdb"
 	"github.com/manx98/local_to_seaf_store/utils"
 	"github.com/manx98/local_to_seaf_store/virtualfs"
 	"github.com/spf13/cobra"
-	"go.etcd.io/bbolt"
 	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"log"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
 	"syscall"
+	"time"
 )
 
 const (
@@ -37,8 +48,38 @@ var dataDir *string
 var parentCommitId *string
 var scanRepoId *string
 var blockSize *int64
-var scanDir *string
+var scanDirs *[]string
 var creator *string
+var incremental *bool
+var hashBlocks *bool
+var checksums *bool
+var symlinks *string
+var strict *bool
+var includes *[]string
+var excludes *[]string
+var excludeFrom *[]string
+var minSize *string
+var maxSize *string
+var maxDepth *int
+var oneFileSystem *bool
+var pruneEmptyDirs *bool
+var hashWorkers *int
+var scanWorkers *int
+var bulkLoad *bool
+var resume *bool
+var bulkEntries *int
+var dryRun *bool
+var jsonReport *bool
+var scanDiff *bool
+var targetPath *string
+var updateHead *bool
+var seafileDB *string
+var mysqlDSN *string
+var seafileConf *string
+var createLibrary *bool
+var conflictPolicy *string
+var libraryName *string
+var libraryOwner *string
 
 var mountCmd = &cobra.Command{
 	Use:   "mount",
@@ -49,158 +90,659 @@ var mountDataDir *string
 var mountRepoId *string
 var pathPrefix *string
 var allowOther *bool
+var overlayDir *string
+var scanSnapshot *bool
+var allRepos *bool
+var rootsConfig *string
+var scrubRate *string
+var scrubInterval *time.Duration
 
-func main() {
-	defer virtualfs.Close()
+func init() {
 	appCmd.AddCommand(scanCmd)
 	dataDir = scanCmd.Flags().StringP("data_dir", "d", "/opt/seafile/seafile-data/storage", "Commit, FS, result will be stored here")
-	parentCommitId = scanCmd.Flags().StringP("parent_commit_id", "p", "363b24f55f52da85cf9eb7fa0f9c8bf30325da75", "The completion of the scan will generate a commit with this parent ID")
+	parentCommitId = scanCmd.Flags().StringP("parent_commit_id", "p", "", "The completion of the scan will generate a commit with this parent ID, default the head of the master branch in the Seafile database")
 	scanRepoId = scanCmd.Flags().StringP("repo_id", "r", "00a57a07-79b0-4156-ab36-a556cfa54d57", "The RepoID corresponding to the scan result fs and commit")
 	blockSize = scanCmd.Flags().Int64P("block_size", "s", 8*1024*1024, "block size")
-	scanDir = scanCmd.Flags().StringP("scan_dir", "m", ".", "Paths to be scanned")
+	scanDirs = scanCmd.Flags().StringArrayP("scan_dir", "m", []string{"."}, "Path to be scanned, or name=path of a named source root placed at /name, can be repeated with named roots")
 	creator = scanCmd.Flags().StringP("creator", "c", "admin", "fs creator")
+	hashBlocks = scanCmd.Flags().Bool("hash_blocks", false, "Use the SHA-1 of the block content as block id instead of a random id")
+	checksums = scanCmd.Flags().Bool("checksums", false, "Record the SHA-256 of every block in the mapping, the scrubber of the mount verifies the blocks against them")
+	hashWorkers = scanCmd.Flags().Int("hash_workers", runtime.NumCPU(), "Number of blocks hashed in parallel when hash_blocks or checksums is set")
+	symlinks = scanCmd.Flags().String("symlinks", SymlinkSkip, "How to handle symbolic links: follow|skip|error, followed links must stay inside scan_dir")
+	strict = scanCmd.Flags().Bool("strict", false, "Fail the scan on special files (fifo, socket, device) instead of skipping them, and on names Seafile does not accept")
+	includes = scanCmd.Flags().StringArray("include", nil, "Gitignore pattern of paths to keep even if an exclude rule matches them, can be repeated")
+	excludes = scanCmd.Flags().StringArray("exclude", nil, "Gitignore pattern of paths to leave out, can be repeated")
+	excludeFrom = scanCmd.Flags().StringArray("exclude-from", nil, "File of gitignore patterns of paths to leave out, can be repeated")
+	minSize = scanCmd.Flags().String("min-size", "", "Leave out files smaller than this size, e.g. 1K")
+	maxSize = scanCmd.Flags().String("max-size", "", "Leave out files larger than this size, e.g. 4G")
+	maxDepth = scanCmd.Flags().Int("max-depth", 0, "Leave out entries nested deeper than this, 0 means unlimited")
+	oneFileSystem = scanCmd.Flags().Bool("one-file-system", false, "Do not descend into directories on other file systems")
+	pruneEmptyDirs = scanCmd.Flags().Bool("prune-empty-dirs", false, "Leave out directories that filtering emptied, directories empty in the source are kept")
+	scanWorkers = scanCmd.Flags().IntP("workers", "w", runtime.NumCPU(), "Number of files and directories scanned in parallel")
+	bulkLoad = scanCmd.Flags().Bool("bulk_load", false, "Buffer mapping writes and apply them in large sorted transactions, for large imports")
+	bulkEntries = scanCmd.Flags().Int("bulk_entries", 500000, "Number of mapping entries buffered in memory before a bulk load flush")
+	resume = scanCmd.Flags().Bool("resume", false, "Continue an interrupted scan, skipping the directories it completed")
+	incremental = scanCmd.Flags().BoolP("incremental", "i", false, "Reuse the fs objects and blocks of files whose size and mtime are unchanged since the last scan")
+	targetPath = scanCmd.Flags().String("target-path", "/", "Library path the scanned directory is placed at, the rest of the parent commit's tree is kept")
+	updateHead = scanCmd.Flags().Bool("update-head", false, "Move the master branch of the library from parent_commit_id to the new commit in the Seafile database")
+	seafileDB = scanCmd.Flags().String("seafile_db", "", "Path of the Seafile SQLite database, default seafile.db in data_dir")
+	mysqlDSN = scanCmd.Flags().String("mysql_dsn", "", "DSN of the Seafile MySQL database, e.g. user:password@tcp(127.0.0.1:3306)/seafile_db, used instead of seafile_db")
+	seafileConf = scanCmd.Flags().String("seafile_conf", "", "Path of seafile.conf to read the Seafile database settings from, used instead of seafile_db")
+	conflictPolicy = scanCmd.Flags().String("conflict", string(mergemgr.KeepBoth), "With update-head, how to merge the entries changed in the library during the scan: scan|library|both")
+	createLibrary = scanCmd.Flags().Bool("create-library", false, "Create a new library for the scan and register it in the Seafile database, repo_id is generated unless given")
+	libraryName = scanCmd.Flags().String("name", "", "Name of the library created by create-library")
+	libraryOwner = scanCmd.Flags().String("owner", "", "Owner email of the library created by create-library")
+	dryRun = scanCmd.Flags().Bool("dry-run", false, "Report what the scan would do without writing fs objects, commits or block mapping")
+	jsonReport = scanCmd.Flags().Bool("json", false, "Print the scan report as JSON to stdout")
+	scanDiff = scanCmd.Flags().Bool("diff", false, "List the changes of the new commit against parent_commit_id, use with dry-run to preview an import")
 	appCmd.AddCommand(mountCmd)
 	mountDataDir = mountCmd.Flags().StringP("data_dir", "d", "/opt/seafile/seafile-data/storage", "The program will mount the blocks directory in this directory")
 	mountRepoId = mountCmd.Flags().StringP("repo_id", "r", "00a57a07-79b0-4156-ab36-a556cfa54d57", "The RepoID corresponding to the scan result fs and commit")
 	pathPrefix = mountCmd.Flags().StringP("path_prefix", "m", ".", "File mapping parent directory, corresponding to scan_dir in the scan")
+	rootsConfig = mountCmd.Flags().String("roots", "", "File of name=path lines giving the directories of the named source roots, roots missing there are taken from the last scan. With --all-repos the names are <repo_id>:<name>, and <repo_id> for the root of a scan without names")
 	allowOther = mountCmd.Flags().BoolP("allow_other", "a", false, "allow_other only allowed if 'user_allow_other' is set in /etc/fuse.conf")
+	allRepos = mountCmd.Flags().Bool("all-repos", false, "Mount the blocks directory itself with a sub-tree per repo of the mapping, blocks of other repos are passed through to the real blocks directory")
+	scrubRate = mountCmd.Flags().String("scrub-rate", "", "Verify the proxy blocks recorded with checksums in the background, reading at most this many bytes per second, e.g. 10M; empty disables the scrubber")
+	scrubInterval = mountCmd.Flags().Duration("scrub-interval", 24*time.Hour, "Pause between two scrub passes over all blocks")
+	overlayDir = mountCmd.Flags().String("overlay", "", "Backing directory of a writable mount, new blocks are stored there and deleted proxy blocks are hidden; deletions fail while a scan holds the mapping")
+	scanSnapshot = mountCmd.Flags().Bool("scan-snapshot", false, "While a scan holds the mapping, serve a copy of it taken when the scan starts instead of failing the reads of proxy blocks; the copy is as large as the mapping")
+	appCmd.AddCommand(fsckCmd)
+	fsckDataDir = fsckCmd.Flags().StringP("data_dir", "d", "/opt/seafile/seafile-data/storage", "Seafile data directory holding the fs objects, commits and blocks")
+	fsckRepoId = fsckCmd.Flags().StringP("repo_id", "r", "00a57a07-79b0-4156-ab36-a556cfa54d57", "The RepoID of the commit")
+	fsckCommitId = fsckCmd.Flags().StringP("commit", "c", "", "The commit to check")
+	fsckPathPrefix = fsckCmd.Flags().StringP("path_prefix", "m", ".", "File mapping parent directory, corresponding to scan_dir in the scan")
+	fsckRoots = fsckCmd.Flags().String("roots", "", "File of name=path lines giving the directories of the named source roots, roots missing there are taken from the last scan")
+	fsckJson = fsckCmd.Flags().Bool("json", false, "Print the fsck report as JSON to stdout")
+	fsckVerifyBlocks = fsckCmd.Flags().Bool("verify-blocks", false, "Read every block and check that its data hashes to its id")
+	fsckOverlay = fsckCmd.Flags().String("overlay", "", "Backing directory of an overlay mount, its blocks are checked instead of the mapped ones")
+	_ = fsckCmd.MarkFlagRequired("commit")
+	appCmd.AddCommand(diffCmd)
+	diffDataDir = diffCmd.Flags().StringP("data_dir", "d", "/opt/seafile/seafile-data/storage", "Seafile data directory holding the fs objects and commits")
+	diffRepoId = diffCmd.Flags().StringP("repo_id", "r", "00a57a07-79b0-4156-ab36-a556cfa54d57", "The RepoID of the commits")
+	diffFrom = diffCmd.Flags().String("from", "", "The commit the changes are listed from")
+	diffTo = diffCmd.Flags().String("to", "", "The commit the changes are listed to")
+	diffJson = diffCmd.Flags().Bool("json", false, "Print the changes as JSON to stdout")
+	_ = diffCmd.MarkFlagRequired("from")
+	_ = diffCmd.MarkFlagRequired("to")
+	appCmd.AddCommand(exportCmd)
+	exportDataDir = exportCmd.Flags().StringP("data_dir", "d", "/opt/seafile/seafile-data/storage", "Seafile data directory holding the fs objects, commits and blocks")
+	exportRepoId = exportCmd.Flags().StringP("repo_id", "r", "00a57a07-79b0-4156-ab36-a556cfa54d57", "The RepoID of the commit")
+	exportCommitId = exportCmd.Flags().StringP("commit", "c", "", "The commit to export")
+	exportPath = exportCmd.Flags().String("path", "/", "Library path of the file or directory to export")
+	exportOut = exportCmd.Flags().StringP("out", "o", "", "Directory the files are written to, or - for a tar stream on stdout")
+	exportPathPrefix = exportCmd.Flags().StringP("path_prefix", "m", ".", "File mapping parent directory, corresponding to scan_dir in the scan")
+	exportRoots = exportCmd.Flags().String("roots", "", "File of name=path lines giving the directories of the named source roots, roots missing there are taken from the last scan")
+	exportVerifyBlocks = exportCmd.Flags().Bool("verify-blocks", false, "Check that the data of every block hashes to its id before the file is written")
+	exportOverlay = exportCmd.Flags().String("overlay", "", "Backing directory of an overlay mount, its blocks are read instead of the mapped ones")
+	_ = exportCmd.MarkFlagRequired("commit")
+	_ = exportCmd.MarkFlagRequired("out")
+	appCmd.AddCommand(logCmd)
+	logDataDir = logCmd.Flags().StringP("data_dir", "d", "/opt/seafile/seafile-data/storage", "Seafile data directory holding the fs objects and commits")
+	logRepoId = logCmd.Flags().StringP("repo_id", "r", "00a57a07-79b0-4156-ab36-a556cfa54d57", "The RepoID of the library")
+	logFrom = logCmd.Flags().String("from", "HEAD", "Commit the history starts at, HEAD is the master branch in the Seafile database")
+	logMaxCount = logCmd.Flags().IntP("max-count", "n", 0, "Number of commits to list, 0 lists all")
+	logStats = logCmd.Flags().Bool("stats", false, "Count the files and bytes of the tree of every commit")
+	logJson = logCmd.Flags().Bool("json", false, "Print the commits as JSON to stdout")
+	logSeafileDB = logCmd.Flags().String("seafile_db", "", "Path of the Seafile SQLite database read for HEAD, default seafile.db in data_dir")
+	logMysqlDSN = logCmd.Flags().String("mysql_dsn", "", "DSN of the Seafile MySQL database, e.g. user:password@tcp(127.0.0.1:3306)/seafile_db, used instead of seafile_db")
+	logSeafileConf = logCmd.Flags().String("seafile_conf", "", "Path of seafile.conf to read the Seafile database settings from, used instead of seafile_db")
+	appCmd.AddCommand(scrubCmd)
+	scrubCmd.AddCommand(scrubStatusCmd)
+	scrubDataDir = scrubStatusCmd.Flags().StringP("data_dir", "d", "/opt/seafile/seafile-data/storage", "Seafile data directory holding the block mapping, its scrub report and the fs objects")
+	scrubJson = scrubStatusCmd.Flags().Bool("json", false, "Print the scrub status as JSON to stdout")
+	scrubSeafileDB = scrubStatusCmd.Flags().String("seafile_db", "", "Path of the Seafile SQLite database read for the library heads, default seafile.db in data_dir")
+	scrubMysqlDSN = scrubStatusCmd.Flags().String("mysql_dsn", "", "DSN of the Seafile MySQL database, e.g. user:password@tcp(127.0.0.1:3306)/seafile_db, used instead of seafile_db")
+	scrubSeafileConf = scrubStatusCmd.Flags().String("seafile_conf", "", "Path of seafile.conf to read the Seafile database settings from, used instead of seafile_db")
+}
+
+func main() {
+	defer virtualfs.Close()
 	if err := appCmd.Execute(); err != nil {
 		log.Fatal("run cmd occur error: ", err)
 	}
 }
 
 func scanFs(cmd *cobra.Command, args []string) {
+	if *jsonReport {
+		// Keep stdout for the report.
+		logger.SetLogWriteSyncer(zapcore.Lock(os.Stderr))
+	}
+	if *createLibrary {
+		if *libraryName == "" || *libraryOwner == "" {
+			logger.Fatal("create-library needs name and owner")
+		}
+		if *parentCommitId != "" || *updateHead {
+			logger.Fatal("create-library cannot be used with parent_commit_id or update-head")
+		}
+		if cmd == nil || !cmd.Flags().Changed("repo_id") {
+			if *resume {
+				logger.Fatal("resume with create-library needs the repo_id of the interrupted scan")
+			}
+			*scanRepoId = uuid.NewString()
+		}
+	}
 	if !utils.IsValidUUID(*scanRepoId) {
 		logger.Fatal("repo_id is not uuid", zap.String("repo_id", *scanRepoId))
 	}
-	if !utils.IsObjectIDValid(*parentCommitId) {
+	if *parentCommitId != "" && !utils.IsObjectIDValid(*parentCommitId) {
 		logger.Fatal("parent_commit_id is not object id", zap.String("parent_commit_id", *parentCommitId))
 	}
-	commitmgr.Init(*dataDir)
-	parentCommit, err := commitmgr.Load(*scanRepoId, *parentCommitId)
+	switch *symlinks {
+	case SymlinkFollow, SymlinkSkip, SymlinkError:
+	default:
+		logger.Fatal("symlinks must be one of follow, skip or error", zap.String("symlinks", *symlinks))
+	}
+	*targetPath = path.Clean("/" + *targetPath)
+	for _, name := range strings.Split(strings.TrimPrefix(*targetPath, "/"), "/") {
+		if err := utils.CheckFileName(name); err != nil && *targetPath != "/" {
+			logger.Fatal("invalid target-path", zap.String("target-path", *targetPath), zap.Error(err))
+		}
+	}
+	policy, err := mergemgr.ParsePolicy(*conflictPolicy)
 	if err != nil {
-		logger.Fatal("get parent commit occur error", zap.Error(err), zap.String("scanRepoId", *scanRepoId), zap.String("parent", *parentCommitId))
+		logger.Fatal("invalid conflict", zap.Error(err))
+	}
+	roots, err := parseScanRoots(*scanDirs)
+	if err != nil {
+		logger.Fatal("invalid scan_dir", zap.Error(err))
 	}
-	fsmgr.Init(*dataDir)
-	if err = virtualfs.InitVirtualFs(filepath.Join(*dataDir, "blocks_mapping.db"), false); err != nil {
+	scanFilter, err := newScanFilter()
+	if err != nil {
+		logger.Fatal("invalid filter", zap.Error(err))
+	}
+	if *dryRun {
+		commitmgr.InitDryRun(*dataDir)
+		fsmgr.InitDryRun(*dataDir)
+	} else {
+		commitmgr.Init(*dataDir)
+		fsmgr.Init(*dataDir)
+	}
+	var seafDB *seafdb.DB
+	if *updateHead || *parentCommitId == "" || *createLibrary {
+		seafDB = openSeafileDB(*dataDir, *seafileDB, *mysqlDSN, *seafileConf)
+		defer seafDB.Close()
+	}
+	var parentCommit *commitmgr.Commit
+	if *createLibrary {
+		parentCommit = createInitialCommit(seafDB)
+	} else {
+		parentCommit = loadParentCommit(seafDB)
+	}
+	sc := DirScanner{
+		Filter:         scanFilter,
+		OneFileSystem:  *oneFileSystem,
+		PruneEmptyDirs: *pruneEmptyDirs,
+		Symlinks:       *symlinks,
+		Strict:         *strict,
+		Incremental:    *incremental || *resume,
+		Resume:         *resume,
+		HashBlocks:     *hashBlocks,
+		HashWorkers:    *hashWorkers,
+		Checksums:      *checksums,
+		Workers:        *scanWorkers,
+		DryRun:         *dryRun,
+	}
+	dbFile := filepath.Join(*dataDir, "blocks_mapping.db")
+	if *dryRun {
+		// The mapping is only read to find reusable files, a missing one is not created. A read-only
+		// mount keeps serving it, the dry run shares its lock.
+		sc.Mapper = virtualfs.NewNopMapper()
+		sc.Resume = false
+		if _, sErr := os.Stat(dbFile); sErr == nil {
+			err = virtualfs.InitVirtualFs(dbFile, true)
+		} else {
+			sc.Incremental = false
+		}
+	} else {
+		// A mount serving the mapping releases it for the scan and reloads it when the mapping is closed.
+		if err = virtualfs.Borrow(dbFile); err != nil {
+			logger.Fatal("borrow mapping from mount occur error", zap.Error(err))
+		}
+		err = virtualfs.InitVirtualFs(dbFile, false)
+	}
+	if err != nil {
 		logger.Fatal("init virtual fs occur error", zap.Error(err))
 	}
-	sc := DirScanner{}
-	rootId, err := sc.Scan(*scanDir, *scanRepoId)
+	if *bulkLoad && !*dryRun {
+		sc.Mapper = virtualfs.NewBulkLoader(*bulkEntries)
+	}
+	if !*dryRun {
+		for _, root := range roots {
+			path := root.Path
+			if root.Name == "" {
+				// A mount of all repos has no path prefix for the root without name.
+				if path, err = filepath.Abs(path); err != nil {
+					logger.Fatal("get absolute path of scan dir occur error", zap.Error(err), zap.String("path", root.Path))
+				}
+			}
+			if err = virtualfs.PutRoot(*scanRepoId, root.Name, path); err != nil {
+				logger.Fatal("record source root occur error", zap.Error(err), zap.String("root", root.Name))
+			}
+		}
+		if err = virtualfs.StartJournal(*scanRepoId, scanOptions(), *resume); err != nil {
+			logger.Fatal("start scan journal occur error", zap.Error(err), zap.Bool("resume", *resume))
+		}
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	rootId, err := scanRoots(ctx, &sc, roots)
 	if err != nil {
-		logger.Fatal("scan occur error", zap.Error(err), zap.String("scanDir", *scanDir))
-		log.Fatal(err)
+		if *dryRun {
+			logger.Fatal("dry run occur error", zap.Error(err), zap.Strings("scanDir", *scanDirs))
+		}
+		// The scanner flushed everything it completed, persist it for a resume.
+		if sErr := virtualfs.Sync(); sErr != nil {
+			logger.Error("sync occur error", zap.Error(sErr))
+		}
+		virtualfs.Close()
+		if ctx.Err() != nil {
+			logger.Fatal("scan interrupted, run it again with --resume to continue", zap.Strings("scanDir", *scanDirs), zap.String("repo_id", *scanRepoId))
+		}
+		logger.Fatal("scan occur error, run it again with --resume to continue", zap.Error(err), zap.Strings("scanDir", *scanDirs), zap.String("repo_id", *scanRepoId))
 	}
-	commit := commitmgr.NewCommit(parentCommit, rootId, *creator, "Auto blocking mapping")
-	err = commitmgr.Save(commit)
+	treeId, err := fsmgr.PutDir(*scanRepoId, parentCommit.RootID, *targetPath, rootId, time.Now().Unix(), *creator)
 	if err != nil {
-		logger.Fatal("save commit occur error", zap.Error(err), zap.String("scanRepoId", *scanRepoId), zap.String("parent", *parentCommitId))
+		logger.Fatal("graft scan into parent tree occur error", zap.Error(err), zap.String("target-path", *targetPath))
+	}
+	commit := commitmgr.NewCommit(parentCommit, treeId, *creator, scanCommitDesc)
+	var changes []*diffmgr.Change
+	if *scanDiff {
+		if changes, err = diffmgr.Diff(*scanRepoId, parentCommit.RootID, treeId); err != nil {
+			logger.Fatal("diff against parent commit occur error", zap.Error(err))
+		}
+	}
+	head := &mergeResult{Commit: commit}
+	if !*dryRun {
+		err = commitmgr.Save(commit)
+		if err != nil {
+			logger.Fatal("save commit occur error", zap.Error(err), zap.String("scanRepoId", *scanRepoId), zap.String("parent", *parentCommitId))
+		}
+		err = virtualfs.ClearJournal(*scanRepoId)
+		if err != nil {
+			logger.Fatal("clear scan journal occur error", zap.Error(err))
+		}
+		err = virtualfs.Sync()
+		if err != nil {
+			logger.Fatal("sync occur error", zap.Error(err))
+		}
+		// A mount must serve the new blocks before the library refers to them.
+		virtualfs.Close()
+		if *createLibrary {
+			if err = registerLibrary(seafDB, commit); err != nil {
+				logger.Fatal("register library occur error", zap.Error(err), zap.String("commit_id", commit.CommitID))
+			}
+		} else if *updateHead {
+			if head, err = advanceHead(seafDB, parentCommit, commit, policy); err != nil {
+				logger.Fatal("update branch head occur error", zap.Error(err), zap.String("commit_id", commit.CommitID))
+			}
+		}
+	}
+	report := &ScanReport{
+		DryRun:      *dryRun,
+		RepoID:      *scanRepoId,
+		ScanDirs:    *scanDirs,
+		TargetPath:  *targetPath,
+		BlockSize:   *blockSize,
+		ParentID:    parentCommit.CommitID,
+		CommitID:    commit.CommitID,
+		RootID:      rootId,
+		HeadID:      head.Commit.CommitID,
+		Conflicts:   head.Conflicts,
+		HeadUpdated: (*updateHead || *createLibrary) && !*dryRun,
+		ScanSummary: &sc.Summary,
+		Changes:     changes,
+	}
+	if *jsonReport {
+		err = report.WriteJSON(os.Stdout)
+	} else if *dryRun {
+		err = report.WriteText(os.Stdout)
+	} else {
+		logScanSummary(report)
+		if changes != nil {
+			err = writeChanges(os.Stdout, changes)
+		}
 	}
-	err = virtualfs.Sync()
 	if err != nil {
-		logger.Fatal("sync occur error", zap.Error(err))
+		logger.Fatal("write scan report occur error", zap.Error(err))
+	}
+	if report.Failed() {
+		virtualfs.Close()
+		logger.Fatal("dry run found problems that would fail the scan", zap.Int("problems", len(sc.Summary.Problems)))
 	}
-	logger.Info("scan success", zap.String("commit_id", commit.CommitID), zap.String("repo_id", *scanRepoId), zap.String("scan_dir", *scanDir))
 }
 
-type DirScanner struct {
+func logScanSummary(report *ScanReport) {
+	summary := report.ScanSummary
+	logger.Info("scan success",
+		zap.String("commit_id", report.CommitID),
+		zap.String("parent_commit_id", report.ParentID),
+		zap.Bool("head_updated", report.HeadUpdated),
+		zap.String("head_commit_id", report.HeadID),
+		zap.Strings("conflicts", report.Conflicts),
+		zap.String("repo_id", *scanRepoId),
+		zap.Strings("scan_dir", *scanDirs),
+		zap.String("target_path", *targetPath),
+		zap.Int64("files", summary.Files),
+		zap.Int64("dirs", summary.Dirs),
+		zap.Int64("bytes", summary.Bytes),
+		zap.Int64("generated_files", summary.Generated),
+		zap.Int64("reused_files", summary.Reused),
+		zap.Int("skipped_links", len(summary.SkippedLinks)),
+		zap.Any("skipped_special_files", summary.SpecialFiles),
+		zap.Int64("excluded_files", summary.ExcludedFiles),
+		zap.Int64("excluded_dirs", summary.ExcludedDirs),
+		zap.Int64("excluded_bytes", summary.ExcludedBytes),
+		zap.Int64("pruned_dirs", summary.PrunedDirs),
+		zap.Int64("resumed_dirs", summary.ResumedDirs),
+	)
+	for _, entry := range summary.SkippedLinks {
+		logger.Warn("skipped symlink", zap.String("path", entry.Path), zap.String("reason", entry.Reason))
+	}
+	for _, entry := range summary.SkippedSpecial {
+		logger.Warn("skipped special file", zap.String("path", entry.Path), zap.String("type", entry.Reason))
+	}
 }
 
-func (d *DirScanner) saveProxyFile(tx *bbolt.Tx, id uint64, offset, size int64, mtime int64) (blkId string, err error) {
-	for {
-		blkId = utils.RandId()
-		savePath := filepath.Join("/", *scanRepoId, blkId[:2], blkId[2:])
-		if offset+*blockSize > size {
-			err = virtualfs.WriteProxyFile(tx, savePath, id, offset, size-offset, mtime)
-		} else {
-			err = virtualfs.WriteProxyFile(tx, savePath, id, offset, *blockSize, mtime)
-		}
+// loadParentCommit loads the parent commit given by parent_commit_id, or the head of the library in db.
+func loadParentCommit(db *seafdb.DB) *commitmgr.Commit {
+	parentSource := "flag"
+	if db != nil {
+		head, err := db.GetBranch(context.Background(), *scanRepoId, seafdb.MasterBranch)
 		if err != nil {
-			if errors.Is(err, syscall.EEXIST) {
-				continue
-			}
-			return "", err
+			logger.Fatal("get branch head occur error", zap.Error(err), zap.String("repo_id", *scanRepoId))
 		}
-		return
+		if *parentCommitId == "" {
+			*parentCommitId, parentSource = head, "database"
+		} else if head != *parentCommitId {
+			logger.Info("branch head is not parent_commit_id, the scan will be merged", zap.String("head", head), zap.String("parent", *parentCommitId))
+		}
+	}
+	parentCommit, err := commitmgr.Load(*scanRepoId, *parentCommitId)
+	if err != nil {
+		logger.Fatal("get parent commit occur error", zap.Error(err), zap.String("scanRepoId", *scanRepoId), zap.String("parent", *parentCommitId))
+	}
+	if parentCommit.RepoID != *scanRepoId || parentCommit.CommitID != *parentCommitId {
+		logger.Fatal("parent commit does not belong to repo_id", zap.String("scanRepoId", *scanRepoId),
+			zap.String("parent", *parentCommitId), zap.String("parent_repo_id", parentCommit.RepoID))
+	}
+	logger.Info("parent commit", zap.String("parent_commit_id", *parentCommitId), zap.String("source", parentSource))
+	return parentCommit
+}
+
+// createInitialCommit saves the first commit of the library to create, the scan commit follows it.
+func createInitialCommit(db *seafdb.DB) *commitmgr.Commit {
+	exists, err := db.RepoExists(context.Background(), *scanRepoId)
+	if err != nil {
+		logger.Fatal("check library occur error", zap.Error(err), zap.String("repo_id", *scanRepoId))
+	}
+	if exists {
+		logger.Fatal("library already exists", zap.String("repo_id", *scanRepoId))
 	}
+	commit := commitmgr.NewInitialCommit(*scanRepoId, *libraryName, "", *libraryOwner)
+	if err = commitmgr.Save(commit); err != nil {
+		logger.Fatal("save initial commit occur error", zap.Error(err), zap.String("repo_id", *scanRepoId))
+	}
+	*parentCommitId = commit.CommitID
+	logger.Info("create library", zap.String("repo_id", *scanRepoId), zap.String("name", *libraryName),
+		zap.String("owner", *libraryOwner), zap.String("initial_commit_id", commit.CommitID))
+	return commit
+}
 
+// registerLibrary registers the library created by the scan in db with its head at commit.
+func registerLibrary(db *seafdb.DB, commit *commitmgr.Commit) error {
+	size, files, err := fsmgr.GetTreeStats(commit.RepoID, commit.RootID)
+	if err != nil {
+		return fmt.Errorf("count library size: %w", err)
+	}
+	return db.CreateRepo(context.Background(), &seafdb.NewRepo{
+		RepoID:     commit.RepoID,
+		Name:       commit.RepoName,
+		Owner:      *libraryOwner,
+		Version:    commit.Version,
+		Head:       commit.CommitID,
+		Size:       size,
+		FileCount:  files,
+		UpdateTime: commit.Ctime,
+	})
 }
-func (d *DirScanner) generateFile(size int64, storePath string, mtime int64) (blkId string, err error) {
-	logger.Info("generate file", zap.String("path", storePath))
-	err = virtualfs.Batch(func(tx *bbolt.Tx) error {
-		var id uint64
-		id, err = virtualfs.PutRealFilePath(tx, []byte(storePath))
-		if err != nil {
-			return err
+
+// openSeafileDB opens the Seafile database given by a MySQL dsn, by seafile.conf, or the SQLite file, in this order.
+func openSeafileDB(dataDir string, dbFile string, dsn string, conf string) *seafdb.DB {
+	driver := seafdb.DriverSQLite
+	if dsn != "" {
+		driver = seafdb.DriverMySQL
+	} else if conf != "" {
+		var err error
+		if driver, dsn, err = seafdb.ReadConfig(conf, dataDir); err != nil {
+			logger.Fatal("read seafile.conf occur error", zap.Error(err))
 		}
-		var ids []string
-		for i := int64(0); i < size; i += *blockSize {
-			blkId, err = d.saveProxyFile(tx, id, i, size, mtime)
-			if err != nil {
-				return err
-			}
-			ids = append(ids, blkId)
+	} else {
+		if dsn = dbFile; dsn == "" {
+			dsn = filepath.Join(dataDir, "seafile.db")
+		}
+		// Opening a missing SQLite file would create an empty database.
+		if _, err := os.Stat(dsn); err != nil {
+			logger.Fatal("seafile database not found", zap.Error(err))
+		}
+	}
+	db, err := seafdb.Open(driver, dsn)
+	if err != nil {
+		logger.Fatal("open seafile database occur error", zap.Error(err))
+	}
+	return db
+}
+
+// scanCommitDesc is the description of the commits saved by scan.
+const scanCommitDesc = "Auto blocking mapping"
+
+// maxMergeAttempts bounds the merges of a scan into a library whose head keeps moving.
+const maxMergeAttempts = 5
+
+// mergeResult is the commit a scan moved the branch to.
+type mergeResult struct {
+	Commit *commitmgr.Commit
+	// Conflicts are the paths changed by both the library and the scan.
+	Conflicts []string
+}
+
+// advanceHead moves the master branch from parent to the scan commit. If the library has moved since parent,
+// the scan is merged into its head with policy and the branch is moved to the merge commit.
+func advanceHead(db *seafdb.DB, parent *commitmgr.Commit, scan *commitmgr.Commit, policy mergemgr.Policy) (*mergeResult, error) {
+	result := &mergeResult{Commit: scan}
+	oldHead := parent.CommitID
+	for attempt := 0; ; attempt++ {
+		err := updateBranchHead(db, oldHead, result.Commit)
+		if !errors.Is(err, seafdb.ErrHeadMoved) || attempt == maxMergeAttempts {
+			return result, err
 		}
-		var fileObj *fsmgr.Seafile
-		fileObj, err = fsmgr.NewSeafile(1, size, ids)
+		if oldHead, err = db.GetBranch(context.Background(), scan.RepoID, seafdb.MasterBranch); err != nil {
+			return nil, err
+		}
+		headCommit, err := commitmgr.Load(scan.RepoID, oldHead)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("load branch head: %w", err)
 		}
-		err = fsmgr.SaveSeafile(*scanRepoId, fileObj)
+		m := &mergemgr.Merger{RepoID: scan.RepoID, Policy: policy, User: *creator, Time: time.Now()}
+		rootId, err := m.Merge(parent.RootID, headCommit.RootID, scan.RootID)
 		if err != nil {
-			return err
+			return nil, fmt.Errorf("merge with %s: %w", oldHead, err)
 		}
-		blkId = fileObj.FileID
-		return nil
-	})
-	return
+		merge := commitmgr.NewCommit(headCommit, rootId, *creator, "Auto merge by system")
+		merge.SecondParentID.SetValid(scan.CommitID)
+		if err = commitmgr.Save(merge); err != nil {
+			return nil, err
+		}
+		logger.Info("merge scan into branch head", zap.String("head", oldHead), zap.String("merge_commit_id", merge.CommitID),
+			zap.Int("conflicts", len(m.Conflicts)), zap.String("policy", string(policy)))
+		result = &mergeResult{Commit: merge, Conflicts: m.Conflicts}
+	}
 }
 
-func (d *DirScanner) Scan(parent string, storePath string) (rootId string, err error) {
-	dir, err := os.ReadDir(parent)
+// updateBranchHead moves the master branch from oldHead to commit.
+func updateBranchHead(db *seafdb.DB, oldHead string, commit *commitmgr.Commit) error {
+	size, files, err := fsmgr.GetTreeStats(commit.RepoID, commit.RootID)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("count library size: %w", err)
 	}
-	entries := make([]*fsmgr.SeafDirent, 0, len(dir))
-	for i := range dir {
-		file := dir[i]
-		filePath := filepath.Join(parent, file.Name())
-		info, iErr := file.Info()
-		if iErr != nil {
-			return "", iErr
-		}
-		if file.IsDir() {
-			rootId, iErr = d.Scan(filePath, storePath+"/"+file.Name())
-			if iErr != nil {
-				return "", iErr
-			}
-			entries = append(entries, fsmgr.NewDirent(rootId, file.Name(), modeDir, info.ModTime().Unix(), *creator, info.Size()))
-		} else {
-			rootId, iErr = d.generateFile(info.Size(), storePath+"/"+file.Name(), info.ModTime().Unix())
-			if iErr != nil {
-				return "", iErr
-			}
-			entries = append(entries, fsmgr.NewDirent(rootId, file.Name(), modeFile, info.ModTime().Unix(), *creator, info.Size()))
+	return db.UpdateHead(context.Background(), &seafdb.HeadUpdate{
+		RepoID:    commit.RepoID,
+		OldHead:   oldHead,
+		NewHead:   commit.CommitID,
+		Size:      size,
+		FileCount: files,
+	})
+}
+
+// scanRoot is a source directory given by --scan_dir.
+type scanRoot struct {
+	// Name is empty for a single directory scanned as the whole tree.
+	Name string
+	Path string
+}
+
+// parseScanRoots parses the --scan_dir values, either one path or name=path pairs.
+func parseScanRoots(values []string) ([]scanRoot, error) {
+	if len(values) == 1 && !strings.Contains(values[0], "=") {
+		return []scanRoot{{Path: values[0]}}, nil
+	}
+	roots := make([]scanRoot, 0, len(values))
+	names := make(map[string]bool)
+	for _, value := range values {
+		name, dir, ok := strings.Cut(value, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: several scan_dir must all be name=path", value)
+		}
+		if err := utils.CheckFileName(name); err != nil {
+			return nil, fmt.Errorf("%q: %w", value, err)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("%q: duplicate root name", value)
+		}
+		names[name] = true
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return nil, err
 		}
+		roots = append(roots, scanRoot{Name: name, Path: abs})
+	}
+	return roots, nil
+}
+
+// scanRoots scans the source roots and returns the root dir id of the scanned tree.
+// Named roots become the directories /name of the tree.
+func scanRoots(ctx context.Context, sc *DirScanner, roots []scanRoot) (string, error) {
+	if len(roots) == 1 && roots[0].Name == "" {
+		return sc.Scan(ctx, roots[0].Path, virtualfs.StorePath(*scanRepoId, ""))
+	}
+	entries := make([]*fsmgr.SeafDirent, 0, len(roots))
+	for _, root := range roots {
+		info, err := os.Stat(root.Path)
+		if err != nil {
+			return "", err
+		}
+		dirId, err := sc.Scan(ctx, root.Path, virtualfs.StorePath(*scanRepoId, root.Name))
+		if err != nil {
+			return "", fmt.Errorf("scan root %s: %w", root.Name, err)
+		}
+		entries = append(entries, fsmgr.NewDirent(dirId, root.Name, modeDir, info.ModTime().Unix(), *creator, 0))
 	}
 	sort.Sort(fsmgr.Dirents(entries))
-	dirObj, err := fsmgr.NewSeafdir(1, entries)
+	dir, err := fsmgr.NewSeafdir(1, entries)
 	if err != nil {
 		return "", err
 	}
-	err = fsmgr.SaveSeafdir(*scanRepoId, dirObj)
-	if err != nil {
+	if err = fsmgr.SaveSeafdir(*scanRepoId, dir); err != nil {
 		return "", err
 	}
-	return dirObj.DirID, nil
+	return dir.DirID, nil
+}
+
+// scanOptions describes the options that affect the generated objects, a scan can only be resumed with the same options.
+func scanOptions() string {
+	return fmt.Sprint(*scanDirs, *blockSize, *hashBlocks, *symlinks, *strict, *creator,
+		*includes, *excludes, *excludeFrom, *minSize, *maxSize, *maxDepth, *oneFileSystem, *pruneEmptyDirs, *checksums)
+}
+
+// newScanFilter builds the filter of the scan from the command line, it returns nil if no filter is set.
+func newScanFilter() (*filter.Filter, error) {
+	if len(*includes) == 0 && len(*excludes) == 0 && len(*excludeFrom) == 0 && *minSize == "" && *maxSize == "" && *maxDepth <= 0 {
+		return nil, nil
+	}
+	f := &filter.Filter{MaxDepth: *maxDepth}
+	var err error
+	if *minSize != "" {
+		if f.MinSize, err = utils.ParseSize(*minSize); err != nil {
+			return nil, err
+		}
+	}
+	if *maxSize != "" {
+		if f.MaxSize, err = utils.ParseSize(*maxSize); err != nil {
+			return nil, err
+		}
+	}
+	for _, file := range *excludeFrom {
+		if err = f.AddExcludeFrom(file); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range *excludes {
+		if err = f.AddExclude(pattern); err != nil {
+			return nil, err
+		}
+	}
+	for _, pattern := range *includes {
+		if err = f.AddInclude(pattern); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
 }
 
 func mountFs(cmd *cobra.Command, args []string) {
-	if !utils.IsValidUUID(*mountRepoId) {
+	if *allRepos {
+		if *overlayDir != "" {
+			logger.Fatal("overlay can not be used with all-repos, the blocks dir is the backing dir")
+		}
+		// Source roots without name are taken from the scans of each repo.
+		*pathPrefix = ""
+	} else if !utils.IsValidUUID(*mountRepoId) {
 		logger.Fatal("repo_id is not uuid", zap.String("repo_id", *scanRepoId))
 	}
-	if err := virtualfs.InitVirtualFs(filepath.Join(*mountDataDir, "blocks_mapping.db"), true); err != nil {
+	// A writable mount records deleted proxy blocks in the mapping.
+	if err := virtualfs.InitVirtualFs(filepath.Join(*mountDataDir, "blocks_mapping.db"), *overlayDir == "" && !*allRepos); err != nil {
 		logger.Fatal("init virtual fs error", zap.Error(err))
 	}
-	virtualfs.Mount(context.Background(), *pathPrefix, filepath.Join(*mountDataDir, "storage", "blocks", *mountRepoId), *mountRepoId, *allowOther)
+	roots := map[string]string{}
+	if *rootsConfig != "" {
+		var err error
+		if roots, err = virtualfs.LoadRootsConfig(*rootsConfig); err != nil {
+			logger.Fatal("load roots config occur error", zap.Error(err))
+		}
+	}
+	resolver := virtualfs.NewRootResolver(*pathPrefix, roots)
+	if *allRepos {
+		resolver.PerRepo = true
+		missing, err := resolver.MissingRoots()
+		if err != nil {
+			logger.Fatal("check source roots occur error", zap.Error(err))
+		}
+		for _, storeRoot := range missing {
+			logger.Error("source root of repo is unknown, its blocks can not be read until the repo is rescanned or the root is given in --roots",
+				zap.String("root", storeRoot))
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *scrubRate != "" {
+		rate, err := utils.ParseSize(*scrubRate)
+		if err != nil || rate <= 0 {
+			logger.Fatal("invalid scrub-rate", zap.String("scrub-rate", *scrubRate), zap.Error(err))
+		}
+		go virtualfs.NewScrubber(resolver, rate, *scrubInterval).Run(ctx)
+	}
+	if *allRepos {
+		virtualfs.MountAll(ctx, resolver, filepath.Join(*mountDataDir, "storage", "blocks"), *allowOther, *scanSnapshot)
+		return
+	}
+	virtualfs.Mount(ctx, resolver, filepath.Join(*mountDataDir, "storage", "blocks", *mountRepoId), *mountRepoId, *allowOther, *overlayDir, *scanSnapshot)
 }
@@ -1,33 +1,144 @@
 package main
 
 import (
+	"bazil.org/fuse"
+	"bytes"
+	"github.com/manx98/local_to_seaf_store/commitmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"go.etcd.io/bbolt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
+const testRepoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+
+// runCmd runs cmd with args after setting back the flags an earlier run changed. A slice flag appends
+// to its value once it was set, so slice flags are emptied and must be given in args.
+func runCmd(cmd *cobra.Command, args ...string) error {
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if v, ok := f.Value.(pflag.SliceValue); ok {
+			_ = v.Replace(nil)
+		} else {
+			_ = f.Value.Set(f.DefValue)
+		}
+		f.Changed = false
+	})
+	appCmd.SetArgs(append([]string{cmd.Name()}, args...))
+	return appCmd.Execute()
+}
+
+// runScanCmd scans root into a new library in dataDir through the scan command and returns the new commit.
+func runScanCmd(t *testing.T, dataDir, root string) *commitmgr.Commit {
+	t.Helper()
+	commitmgr.Init(dataDir)
+	parent := commitmgr.NewInitialCommit(testRepoId, "test", "", "me@qq.com")
+	if err := commitmgr.Save(parent); err != nil {
+		t.Fatal(err)
+	}
+	err := runCmd(scanCmd, "--data_dir", dataDir, "--parent_commit_id", parent.CommitID, "--repo_id", testRepoId,
+		"--block_size", "1024", "--scan_dir", root, "--creator", "me@qq.com", "--target-path", "/pool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var commit *commitmgr.Commit
+	err = filepath.WalkDir(filepath.Join(dataDir, "storage", "commits", testRepoId), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		id := filepath.Base(filepath.Dir(path)) + d.Name()
+		if id != parent.CommitID {
+			commit, err = commitmgr.Load(testRepoId, id)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit == nil || commit.ParentID.String != parent.CommitID {
+		t.Fatalf("scan committed %+v on parent %s", commit, parent.CommitID)
+	}
+	return commit
+}
+
 func Test_scanFs(t *testing.T) {
-	dataDir = new(string)
-	*dataDir = "/seafile-data"
-	parentCommitId = new(string)
-	*parentCommitId = "7c4be441b8f7f9c999f29837716ea79e44437995"
-	scanRepoId = new(string)
-	*scanRepoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
-	blockSize = new(int64)
-	*blockSize = 8 * 1024 * 1024
-	scanDir = new(string)
-	*scanDir = "/cdrom/pool"
-	creator = new(string)
-	*creator = "me@qq.com"
-	scanFs(nil, nil)
+	root := makeScanTree(t)
+	dataDir := t.TempDir()
+	commit := runScanCmd(t, dataDir, root)
+	var files []string
+	err := fsmgr.Walk(testRepoId, commit.RootID, func(dirPath string, dirent *fsmgr.SeafDirent) error {
+		if !fsmgr.IsDir(dirent.Mode) {
+			files = append(files, dirPath)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 64 || !strings.HasPrefix(files[0], "/pool/dir") {
+		t.Fatalf("committed files %v, want the 64 files of the scan under /pool", files)
+	}
+	if err = virtualfs.InitVirtualFs(filepath.Join(dataDir, "blocks_mapping.db"), true); err != nil {
+		t.Fatal(err)
+	}
+	defer virtualfs.Close()
+	checkFileBlocks(t, root, testRepoId+"/dir7/sub/file7")
 }
 
 func Test_mount(t *testing.T) {
-	mountDataDir = new(string)
-	*mountDataDir = "/seafile-data"
-	pathPrefix = new(string)
-	*pathPrefix = "/cdrom/pool"
-	mountRepoId = new(string)
-	*mountRepoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
-	allowOther = new(bool)
-	*allowOther = true
-	mountFs(nil, nil)
+	root := makeScanTree(t)
+	dataDir := t.TempDir()
+	runScanCmd(t, dataDir, root)
+	if err := virtualfs.InitVirtualFs(filepath.Join(dataDir, "blocks_mapping.db"), true); err != nil {
+		t.Fatal(err)
+	}
+	var info *virtualfs.RealFileInfo
+	err := virtualfs.View(func(tx *bbolt.Tx) (err error) {
+		info, err = virtualfs.GetRealFileInfo(tx, []byte(testRepoId+"/dir7/sub/file7"))
+		return
+	})
+	virtualfs.Close()
+	if err != nil || info == nil {
+		t.Fatalf("info of file7: %v, %v", info, err)
+	}
+	want, err := os.ReadFile(filepath.Join(root, "dir7/sub/file7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = exec.LookPath("fusermount3"); err != nil {
+		t.Skip("mounting needs fusermount3:", err)
+	}
+	mountPoint := filepath.Join(dataDir, "storage", "blocks", testRepoId)
+	done := make(chan error, 1)
+	go func() {
+		done <- runCmd(mountCmd, "--data_dir", dataDir, "--repo_id", testRepoId, "--path_prefix", root)
+	}()
+	defer virtualfs.Close()
+	blkId := info.BlkIDs[0]
+	var got []byte
+	for i := 0; i < 100; i++ {
+		// A read of the mount from the process serving it can hang, the block is read by cat.
+		if got, err = exec.Command("cat", filepath.Join(mountPoint, blkId[:2], blkId[2:])).Output(); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if uErr := fuse.Unmount(mountPoint); uErr != nil {
+		t.Error(uErr)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want[:1024]) {
+		t.Errorf("mounted block %s differs from the first block of file7", blkId)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/diffmgr"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// ScanReport is the result of a scan as printed by --json, or as the summary of a dry run.
+type ScanReport struct {
+	DryRun     bool     `json:"dry_run"`
+	RepoID     string   `json:"repo_id"`
+	ScanDirs   []string `json:"scan_dirs"`
+	TargetPath string   `json:"target_path"`
+	BlockSize  int64    `json:"block_size"`
+	ParentID   string   `json:"parent_commit_id"`
+	// CommitID is the commit the scan saved, or would save in a dry run.
+	CommitID string `json:"commit_id"`
+	// RootID is the dir object of the scanned directory, not of the library root.
+	RootID string `json:"root_id"`
+	// HeadID is the commit the branch was moved to, a merge commit if the library moved during the scan.
+	HeadID string `json:"head_commit_id"`
+	// Conflicts are the paths the merge found changed by both the library and the scan.
+	Conflicts []string `json:"conflicts"`
+	// HeadUpdated is set when the master branch was moved to CommitID.
+	HeadUpdated bool `json:"head_updated"`
+	// Changes are the changes of the commit against the parent, set by --diff.
+	Changes []*diffmgr.Change `json:"changes,omitempty"`
+	*ScanSummary
+}
+
+// Failed reports whether the dry run found problems that would fail the scan, it then exits non-zero.
+func (r *ScanReport) Failed() bool {
+	return r.DryRun && len(r.Problems) > 0
+}
+
+func (r *ScanReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r *ScanReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	if r.DryRun {
+		fmt.Fprintf(tw, "Dry run of %s, nothing was written.\n\n", strings.Join(r.ScanDirs, ", "))
+	}
+	fmt.Fprintf(tw, "Files:\t%d\n", r.Files)
+	fmt.Fprintf(tw, "Directories:\t%d\n", r.Dirs)
+	fmt.Fprintf(tw, "Bytes:\t%d (%s)\n", r.Bytes, formatSize(r.Bytes))
+	fmt.Fprintf(tw, "Blocks:\t%d of %s\n", r.Blocks, formatSize(r.BlockSize))
+	fmt.Fprintf(tw, "Reused files:\t%d\n", r.Reused)
+	fmt.Fprintf(tw, "Excluded:\t%d files, %d dirs, %s\n", r.ExcludedFiles, r.ExcludedDirs, formatSize(r.ExcludedBytes))
+	fmt.Fprintf(tw, "Pruned dirs:\t%d\n", r.PrunedDirs)
+	fmt.Fprintf(tw, "Skipped symlinks:\t%d\n", len(r.SkippedLinks))
+	fmt.Fprintf(tw, "Skipped special files:\t%d\n", len(r.SkippedSpecial))
+	fmt.Fprintf(tw, "Rejected names:\t%d\n", len(r.RejectedNames))
+	fmt.Fprintf(tw, "Problems:\t%d\n", len(r.Problems))
+	if len(r.LargestDirs) > 0 {
+		fmt.Fprintf(tw, "\nLargest directories:\n")
+		for _, dir := range r.LargestDirs {
+			fmt.Fprintf(tw, "  %s\t%s\n", formatSize(dir.Bytes), dir.Path)
+		}
+	}
+	for _, section := range []struct {
+		title   string
+		entries []SkippedEntry
+	}{
+		{"Rejected names", r.RejectedNames},
+		{"Skipped special files", r.SkippedSpecial},
+		{"Skipped symlinks", r.SkippedLinks},
+		{"Problems", r.Problems},
+	} {
+		if len(section.entries) == 0 {
+			continue
+		}
+		fmt.Fprintf(tw, "\n%s:\n", section.title)
+		for _, entry := range section.entries {
+			fmt.Fprintf(tw, "  %s\t%s\n", entry.Path, entry.Reason)
+		}
+	}
+	if len(r.SpecialFiles) > 0 {
+		types := make([]string, 0, len(r.SpecialFiles))
+		for t := range r.SpecialFiles {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		fmt.Fprintf(tw, "\nSpecial files by type:\n")
+		for _, t := range types {
+			fmt.Fprintf(tw, "  %s\t%d\n", t, r.SpecialFiles[t])
+		}
+	}
+	if err := tw.Flush(); err != nil || r.Changes == nil {
+		return err
+	}
+	fmt.Fprintf(w, "\nChanges against %s:\n", r.ParentID)
+	return writeChanges(w, r.Changes)
+}
+
+// formatSize formats n bytes with a binary unit, e.g. 1.5G.
+func formatSize(n int64) string {
+	const units = "KMGTPE"
+	if n < 1024 {
+		return fmt.Sprintf("%dB", n)
+	}
+	f, i := float64(n)/1024, 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", f, units[i])
+}
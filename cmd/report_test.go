@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestDirScanner_DryRunReport(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"ok.txt", "bad\xff.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := syscall.Mkfifo(filepath.Join(root, "pipe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		dryRun, strict bool
+		rejected       int
+		problems       int
+	}{
+		// A real scan keeps the name Seafile does not accept, a dry run reports it.
+		{dryRun: false},
+		{dryRun: true, rejected: 1},
+		// The problems of a strict scan fail the dry run.
+		{dryRun: true, strict: true, rejected: 1, problems: 2},
+	} {
+		initScanTest(t)
+		sc := DirScanner{DryRun: tt.dryRun, Strict: tt.strict, Workers: 1}
+		if tt.dryRun {
+			sc.Mapper = virtualfs.NewNopMapper()
+		}
+		rootId, err := sc.Scan(context.Background(), root, *scanRepoId)
+		virtualfs.Close()
+		if err != nil {
+			t.Fatalf("dry run %v, strict %v: %v", tt.dryRun, tt.strict, err)
+		}
+		report := &ScanReport{DryRun: tt.dryRun, ScanDirs: []string{root}, BlockSize: *blockSize, RootID: rootId, ScanSummary: &sc.Summary}
+		if len(sc.Summary.RejectedNames) != tt.rejected || len(sc.Summary.Problems) != tt.problems || report.Failed() != (tt.problems > 0) {
+			t.Errorf("dry run %v, strict %v: rejected %v, problems %v, failed %v", tt.dryRun, tt.strict, sc.Summary.RejectedNames, sc.Summary.Problems, report.Failed())
+		}
+		if !tt.strict && sc.Summary.Files != 2 {
+			t.Errorf("dry run %v: scanned %d files, want 2", tt.dryRun, sc.Summary.Files)
+		}
+		if !tt.dryRun {
+			continue
+		}
+		var buf bytes.Buffer
+		if err = report.WriteText(&buf); err != nil {
+			t.Fatal(err)
+		}
+		wants := []string{"nothing was written", "Rejected names:         1", filepath.Join(root, "bad\xff.txt")}
+		if tt.strict {
+			wants = append(wants, "Problems:\n")
+		} else {
+			wants = append(wants, "Files:                  2", "Skipped special files:  1")
+		}
+		for _, want := range wants {
+			if !strings.Contains(buf.String(), want) {
+				t.Errorf("strict %v: report misses %q:\n%s", tt.strict, want, buf.String())
+			}
+		}
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/filter"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"github.com/manx98/local_to_seaf_store/utils"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+var errScanAborted = errors.New("scan aborted")
+
+// errFiltered is returned by scanEntry for an entry that filtering leaves out.
+var errFiltered = errors.New("entry filtered out")
+
+// Symlink policies of DirScanner.
+const (
+	SymlinkFollow = "follow"
+	SymlinkSkip   = "skip"
+	SymlinkError  = "error"
+)
+
+// SkippedEntry is an entry of the scanned tree that was left out of the library.
+type SkippedEntry struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// DirUsage is the size of the files in a directory and its subdirectories.
+type DirUsage struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+// largestDirsCount is the number of directories in ScanSummary.LargestDirs.
+const largestDirsCount = 10
+
+// ScanSummary collects the statistics of a scan.
+// Subtrees taken from the scan journal are not counted in the statistics of files, directories and bytes.
+type ScanSummary struct {
+	Files        int64          `json:"files"`
+	Dirs         int64          `json:"dirs"`
+	Bytes        int64          `json:"bytes"`
+	Blocks       int64          `json:"blocks"`
+	Generated    int64          `json:"generated_files"`
+	Reused       int64          `json:"reused_files"`
+	SkippedLinks []SkippedEntry `json:"skipped_links"`
+	// SpecialFiles counts the skipped special files by type.
+	SpecialFiles   map[string]int64 `json:"special_files"`
+	SkippedSpecial []SkippedEntry   `json:"skipped_special"`
+	ExcludedFiles  int64            `json:"excluded_files"`
+	ExcludedDirs   int64            `json:"excluded_dirs"`
+	// ExcludedBytes is the size of the excluded files, the content of excluded directories is not counted.
+	ExcludedBytes int64 `json:"excluded_bytes"`
+	PrunedDirs    int64 `json:"pruned_dirs"`
+	// ResumedDirs counts the directories taken from the scan journal.
+	ResumedDirs int64 `json:"resumed_dirs"`
+	// RejectedNames are the entries whose names Seafile does not accept, reported by a dry run.
+	RejectedNames []SkippedEntry `json:"rejected_names"`
+	// Problems are the errors a dry run met, each of them would fail a real scan.
+	Problems    []SkippedEntry `json:"problems"`
+	LargestDirs []DirUsage     `json:"largest_dirs"`
+}
+
+type DirScanner struct {
+	// Symlinks is the policy applied to symbolic links, one of SymlinkFollow, SymlinkSkip or SymlinkError.
+	// Followed links must resolve inside the scanned directory.
+	Symlinks string
+	// Filter excludes entries from the scan, it may be nil.
+	Filter *filter.Filter
+	// OneFileSystem skips directories on other file systems than the scan root.
+	OneFileSystem bool
+	// PruneEmptyDirs leaves out directories that filtering emptied, those empty in the source are kept.
+	PruneEmptyDirs bool
+	// Strict fails the scan on special files instead of skipping them, and on names Seafile does not accept.
+	Strict bool
+	// Incremental reuses the fs object and blocks of files whose size and mtime are unchanged since the last scan.
+	Incremental bool
+	// HashBlocks uses the SHA-1 of every block as its id instead of a random id.
+	HashBlocks bool
+	// HashWorkers is the number of blocks hashed in parallel.
+	HashWorkers int
+	// Checksums records the SHA-256 of every block in the mapping, for the scrubber of the mount.
+	Checksums bool
+	// Mapper registers the scanned files, NewMapper() is used if it is nil.
+	Mapper virtualfs.Mapper
+	// DryRun records the errors in the summary and goes on instead of failing the scan.
+	DryRun bool
+	// Resume reuses the directories recorded in the scan journal by an interrupted scan.
+	Resume bool
+	// Workers is the number of files and directories scanned in parallel.
+	Workers   int
+	Summary   ScanSummary
+	root      string
+	storeRoot string
+	ctx       context.Context
+	mu        sync.Mutex
+	workers   chan struct{}
+	failed    atomic.Bool
+}
+
+// reuseFile returns the file id recorded by the last scan of storePath if the file is unchanged
+// and all of its objects, and checksums if Checksums is set, are still available, otherwise it returns an empty id.
+func (d *DirScanner) reuseFile(state *virtualfs.RealFileInfo, storePath string) (fileId string, err error) {
+	// The view includes the entries a bulk loader has not flushed yet, e.g. the stale blocks of a changed file.
+	err = d.Mapper.View(func(v *virtualfs.MappingView) error {
+		info, iErr := v.RealFileInfo(storePath)
+		if iErr != nil || info == nil || !info.Unchanged(state) {
+			return iErr
+		}
+		for _, blkId := range info.BlkIDs {
+			blkPath := virtualfs.ProxyPath(*scanRepoId, blkId)
+			if !v.ProxyExists(blkPath) || v.IsStale(blkPath) {
+				return nil
+			}
+			if owner := v.ProxyOwner(blkPath); owner != storePath && !d.ownerUnchanged(v, owner) {
+				return nil
+			}
+			// The file is hashed again to record the checksums a scan without them left out.
+			if d.Checksums && !v.HasChecksum(blkPath) {
+				return nil
+			}
+		}
+		if fsmgr.Exists(*scanRepoId, info.FileID) {
+			fileId = info.FileID
+		}
+		return nil
+	})
+	return
+}
+
+// ownerUnchanged reports whether the real file owner, which wrote a content-addressed block shared with
+// another file, keeps it valid: it is outside of this scan or unchanged since its last scan.
+// Otherwise the block goes stale when the scan reaches the owner, and the sharing file must take it over.
+func (d *DirScanner) ownerUnchanged(v *virtualfs.MappingView, owner string) bool {
+	rel, ok := strings.CutPrefix(owner, d.storeRoot+"/")
+	if !ok {
+		return true
+	}
+	stat, err := os.Stat(filepath.Join(d.root, rel))
+	if err != nil {
+		return false
+	}
+	info, err := v.RealFileInfo(owner)
+	return err == nil && info != nil && info.Unchanged(virtualfs.NewRealFileInfo(stat))
+}
+
+// hashBlocks computes the SHA-1 of every block of the file if HashBlocks is set, and the SHA-256 if Checksums is set.
+func (d *DirScanner) hashBlocks(filePath string, size int64) (ids []string, sums [][]byte, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	ids = make([]string, (size+*blockSize-1) / *blockSize)
+	sums = make([][]byte, len(ids))
+	workers := d.HashWorkers
+	if workers <= 0 {
+		workers = 1
+	}
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var hashErr error
+	for i := range ids {
+		if err = d.ctx.Err(); err != nil {
+			break
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			offset := int64(i) * *blockSize
+			n := min(*blockSize, size-offset)
+			var hashes []io.Writer
+			h, sum := sha1.New(), sha256.New()
+			if d.HashBlocks {
+				hashes = append(hashes, h)
+			}
+			if d.Checksums {
+				hashes = append(hashes, sum)
+			}
+			copied, err := io.Copy(io.MultiWriter(hashes...), io.NewSectionReader(f, offset, n))
+			if err == nil && copied != n {
+				err = fmt.Errorf("%s changed during scan: %w", filePath, io.ErrUnexpectedEOF)
+			}
+			if err != nil {
+				errOnce.Do(func() { hashErr = err })
+				return
+			}
+			ids[i] = hex.EncodeToString(h.Sum(nil))
+			sums[i] = sum.Sum(nil)
+		}(i)
+	}
+	wg.Wait()
+	if hashErr == nil {
+		hashErr = err
+	}
+	if !d.HashBlocks {
+		ids = nil
+	}
+	if !d.Checksums {
+		sums = nil
+	}
+	return ids, sums, hashErr
+}
+
+func (d *DirScanner) generateFile(filePath string, info os.FileInfo, storePath string) (blkId string, err error) {
+	state := virtualfs.NewRealFileInfo(info)
+	size := state.Size
+	if d.Incremental {
+		blkId, err = d.reuseFile(state, storePath)
+		if err != nil || blkId != "" {
+			if blkId != "" {
+				logger.Debug("reuse file", zap.String("path", storePath), zap.String("file_id", blkId))
+				d.mu.Lock()
+				d.Summary.Reused++
+				d.mu.Unlock()
+			}
+			return
+		}
+	}
+	var hashes []string
+	var sums [][]byte
+	if d.HashBlocks || d.Checksums {
+		if hashes, sums, err = d.hashBlocks(filePath, size); err != nil {
+			return "", err
+		}
+	}
+	logger.Info("generate file", zap.String("path", storePath))
+	kind := virtualfs.ProxyContent
+	if hashes == nil {
+		kind = virtualfs.ProxyRandom
+	}
+	for {
+		ids := hashes
+		if ids == nil {
+			ids = make([]string, (size+*blockSize-1) / *blockSize)
+			for i := range ids {
+				ids[i] = utils.RandId()
+			}
+		}
+		var fileObj *fsmgr.Seafile
+		fileObj, err = fsmgr.NewSeafile(1, size, ids)
+		if err != nil {
+			return "", err
+		}
+		err = d.Mapper.PutFile(*scanRepoId, storePath, &virtualfs.RealFileInfo{
+			Size:   size,
+			Mtime:  state.Mtime,
+			Ino:    state.Ino,
+			Ctime:  state.Ctime,
+			FileID: fileObj.FileID,
+			BlkIDs: ids,
+			Sums:   sums,
+		}, *blockSize, kind)
+		// A random block id is already taken, try again with new ones.
+		if errors.Is(err, syscall.EEXIST) && kind == virtualfs.ProxyRandom {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		// Saved once its block ids are taken, a retry leaves no object behind.
+		if err = fsmgr.SaveSeafile(*scanRepoId, fileObj); err != nil {
+			return "", err
+		}
+		d.mu.Lock()
+		d.Summary.Generated++
+		d.mu.Unlock()
+		return fileObj.FileID, nil
+	}
+}
+
+// Scan scans the directory parent and returns the id of the generated dir object.
+// Completed directories are recorded in the scan journal, so an interrupted scan can be resumed.
+// When ctx is cancelled the scan stops at the next entry and everything mapped so far is flushed.
+func (d *DirScanner) Scan(ctx context.Context, parent string, storePath string) (rootId string, err error) {
+	if d.root, err = filepath.Abs(parent); err != nil {
+		return "", err
+	}
+	if d.root, err = filepath.EvalSymlinks(d.root); err != nil {
+		return "", err
+	}
+	info, err := os.Stat(parent)
+	if err != nil {
+		return "", err
+	}
+	d.storeRoot = storePath
+	if d.Mapper == nil {
+		d.Mapper = virtualfs.NewMapper()
+	}
+	d.workers = make(chan struct{}, max(d.Workers-1, 0))
+	d.ctx = ctx
+	rootId, _, _, err = d.scanDir(parent, storePath, []os.FileInfo{info})
+	// Everything buffered belongs to completed files and directories, keep it for a resume.
+	if fErr := d.Mapper.Flush(); err == nil {
+		err = fErr
+	}
+	// Parallel workers report skipped entries in any order.
+	for _, list := range [][]SkippedEntry{d.Summary.SkippedLinks, d.Summary.SkippedSpecial, d.Summary.RejectedNames, d.Summary.Problems} {
+		sort.Slice(list, func(i, j int) bool { return list[i].Path < list[j].Path })
+	}
+	return
+}
+
+// run runs task on an idle worker, or on the calling goroutine if all workers are busy.
+func (d *DirScanner) run(wg *sync.WaitGroup, task func()) {
+	wg.Add(1)
+	select {
+	case d.workers <- struct{}{}:
+		go func() {
+			defer func() {
+				<-d.workers
+				wg.Done()
+			}()
+			task()
+		}()
+	default:
+		defer wg.Done()
+		task()
+	}
+}
+
+// excluded reports whether the filter leaves out the entry at storePath, counting it in the summary if so.
+func (d *DirScanner) excluded(storePath string, info os.FileInfo, ancestors []os.FileInfo) bool {
+	if d.Filter == nil && !d.OneFileSystem {
+		return false
+	}
+	rel := strings.TrimPrefix(storePath, d.storeRoot+"/")
+	excluded := false
+	if d.Filter != nil {
+		excluded = d.Filter.Excluded(rel, info.IsDir()) || d.Filter.DepthExcluded(strings.Count(rel, "/")+1)
+		if !excluded && info.Mode().IsRegular() {
+			excluded = d.Filter.SizeExcluded(info.Size())
+		}
+	}
+	if !excluded && d.OneFileSystem && info.IsDir() {
+		excluded = deviceOf(info) != deviceOf(ancestors[0])
+	}
+	if excluded {
+		logger.Debug("exclude", zap.String("path", rel))
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if info.IsDir() {
+			d.Summary.ExcludedDirs++
+		} else {
+			d.Summary.ExcludedFiles++
+			d.Summary.ExcludedBytes += info.Size()
+		}
+	}
+	return excluded
+}
+
+func deviceOf(info os.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev)
+	}
+	return 0
+}
+
+func (d *DirScanner) skipLink(filePath string, reason string) {
+	logger.Debug("skip symlink", zap.String("path", filePath), zap.String("reason", reason))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Summary.SkippedLinks = append(d.Summary.SkippedLinks, SkippedEntry{Path: filePath, Reason: reason})
+}
+
+// specialFileType returns the type name of a file that is neither regular nor a directory.
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "char_device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	default:
+		return "irregular"
+	}
+}
+
+func (d *DirScanner) skipSpecial(filePath string, mode os.FileMode) error {
+	fileType := specialFileType(mode)
+	if d.Strict {
+		return fmt.Errorf("%s is a special file (%s)", filePath, fileType)
+	}
+	logger.Debug("skip special file", zap.String("path", filePath), zap.String("type", fileType))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.Summary.SpecialFiles == nil {
+		d.Summary.SpecialFiles = make(map[string]int64)
+	}
+	d.Summary.SpecialFiles[fileType]++
+	d.Summary.SkippedSpecial = append(d.Summary.SkippedSpecial, SkippedEntry{Path: filePath, Reason: fileType})
+	return nil
+}
+
+// followLink returns the info of the link target, or nil if the link is skipped.
+// ancestors are the directories from the scan root to the directory containing the link.
+func (d *DirScanner) followLink(filePath string, ancestors []os.FileInfo) (os.FileInfo, error) {
+	switch d.Symlinks {
+	case SymlinkFollow:
+	case SymlinkError:
+		return nil, fmt.Errorf("%s is a symlink", filePath)
+	default:
+		d.skipLink(filePath, "symlink")
+		return nil, nil
+	}
+	target, err := filepath.Abs(filePath)
+	if err == nil {
+		target, err = filepath.EvalSymlinks(target)
+	}
+	if err != nil {
+		d.skipLink(filePath, fmt.Sprintf("broken link: %v", err))
+		return nil, nil
+	}
+	if rel, err := filepath.Rel(d.root, target); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		d.skipLink(filePath, "target outside scan dir: "+target)
+		return nil, nil
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		d.skipLink(filePath, fmt.Sprintf("stat target: %v", err))
+		return nil, nil
+	}
+	if info.IsDir() {
+		for _, ancestor := range ancestors {
+			if os.SameFile(ancestor, info) {
+				d.skipLink(filePath, "loop to "+target)
+				return nil, nil
+			}
+		}
+	}
+	return info, nil
+}
+
+// scanEntry scans an entry of the directory parent and returns its dirent and the size of its content.
+// It returns a nil dirent if the entry is left out, and errFiltered if filtering left it out.
+func (d *DirScanner) scanEntry(parent string, storePath string, file os.DirEntry, ancestors []os.FileInfo) (*fsmgr.SeafDirent, int64, error) {
+	filePath := filepath.Join(parent, file.Name())
+	fileStorePath := storePath + "/" + file.Name()
+	if err := utils.CheckFileName(file.Name()); err != nil {
+		if err = d.rejectName(filePath, err); err != nil {
+			return nil, 0, err
+		}
+	}
+	info, err := file.Info()
+	if err != nil {
+		return nil, 0, err
+	}
+	if d.excluded(fileStorePath, info, ancestors) {
+		return nil, 0, errFiltered
+	}
+	if file.Type()&os.ModeSymlink != 0 {
+		info, err = d.followLink(filePath, ancestors)
+		if err != nil || info == nil {
+			return nil, 0, err
+		}
+		if d.excluded(fileStorePath, info, ancestors) {
+			return nil, 0, errFiltered
+		}
+	}
+	if info.IsDir() {
+		dirId, size, filtered, err := d.scanDir(filePath, fileStorePath, append(ancestors[:len(ancestors):len(ancestors)], info))
+		if err != nil {
+			return nil, 0, err
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		// Only filtering empties a directory for pruning, one that is empty in the source is kept.
+		if d.PruneEmptyDirs && filtered && dirId == fsmgr.EmptySha1 {
+			d.Summary.PrunedDirs++
+			return nil, 0, errFiltered
+		}
+		d.Summary.Dirs++
+		return fsmgr.NewDirent(dirId, file.Name(), modeDir, info.ModTime().Unix(), *creator, info.Size()), size, nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil, 0, d.skipSpecial(filePath, info.Mode())
+	}
+	fileId, err := d.generateFile(filePath, info, fileStorePath)
+	if err != nil {
+		return nil, 0, err
+	}
+	d.mu.Lock()
+	d.Summary.Files++
+	d.Summary.Bytes += info.Size()
+	d.Summary.Blocks += (info.Size() + *blockSize - 1) / *blockSize
+	d.mu.Unlock()
+	return fsmgr.NewDirent(fileId, file.Name(), modeFile, info.ModTime().Unix(), *creator, info.Size()), info.Size(), nil
+}
+
+// rejectName handles an entry whose name Seafile does not accept. The entry is scanned like any other unless Strict
+// fails the scan, a dry run reports the name.
+func (d *DirScanner) rejectName(filePath string, err error) error {
+	if d.DryRun {
+		d.mu.Lock()
+		d.Summary.RejectedNames = append(d.Summary.RejectedNames, SkippedEntry{Path: filePath, Reason: err.Error()})
+		d.mu.Unlock()
+	}
+	if d.Strict {
+		return fmt.Errorf("%s: %w", filePath, err)
+	}
+	return nil
+}
+
+// problem records an error that fails the scan, a dry run records it and goes on.
+func (d *DirScanner) problem(filePath string, err error) error {
+	if !d.DryRun || d.ctx.Err() != nil {
+		return err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Summary.Problems = append(d.Summary.Problems, SkippedEntry{Path: filePath, Reason: err.Error()})
+	return nil
+}
+
+// noteDirUsage keeps the largest directories of the scan.
+func (d *DirScanner) noteDirUsage(storePath string, size int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dirs := d.Summary.LargestDirs
+	if len(dirs) == largestDirsCount && dirs[len(dirs)-1].Bytes >= size {
+		return
+	}
+	i := sort.Search(len(dirs), func(i int) bool { return dirs[i].Bytes < size })
+	dirs = append(dirs, DirUsage{})
+	copy(dirs[i+1:], dirs[i:])
+	name, rel, _ := virtualfs.SplitStorePath(storePath)
+	if name != "" {
+		rel = "/" + name + rel
+	}
+	dirs[i] = DirUsage{Path: "/" + strings.Trim(rel, "/"), Bytes: size}
+	if len(dirs) > largestDirsCount {
+		dirs = dirs[:largestDirsCount]
+	}
+	d.Summary.LargestDirs = dirs
+}
+
+// scanDir scans the directory parent and returns its dir object id, the size of its content and whether
+// filtering left out any of its entries.
+func (d *DirScanner) scanDir(parent string, storePath string, ancestors []os.FileInfo) (rootId string, size int64, filtered bool, err error) {
+	if d.Resume {
+		if rootId, err = virtualfs.GetCheckpoint(storePath); err != nil {
+			return "", 0, false, err
+		}
+		// The journal does not tell whether filtering emptied a directory, an empty one is scanned again to prune it.
+		if rootId != "" && fsmgr.Exists(*scanRepoId, rootId) && !(d.PruneEmptyDirs && rootId == fsmgr.EmptySha1) {
+			logger.Debug("resume dir", zap.String("path", storePath), zap.String("dir_id", rootId))
+			d.mu.Lock()
+			d.Summary.ResumedDirs++
+			d.mu.Unlock()
+			return rootId, 0, false, nil
+		}
+	}
+	dir, err := os.ReadDir(parent)
+	if err != nil {
+		if err = d.problem(parent, err); err != nil {
+			return "", 0, false, err
+		}
+	}
+	results := make([]*fsmgr.SeafDirent, len(dir))
+	sizes := make([]int64, len(dir))
+	var wg sync.WaitGroup
+	var errOnce sync.Once
+	var leftOut atomic.Bool
+	for i := range dir {
+		i := i
+		d.run(&wg, func() {
+			if d.failed.Load() {
+				return
+			}
+			if cErr := d.ctx.Err(); cErr != nil {
+				d.failed.Store(true)
+				errOnce.Do(func() { err = cErr })
+				return
+			}
+			var iErr error
+			results[i], sizes[i], iErr = d.scanEntry(parent, storePath, dir[i], ancestors)
+			if iErr == errFiltered {
+				leftOut.Store(true)
+				iErr = nil
+			}
+			if iErr != nil {
+				iErr = d.problem(filepath.Join(parent, dir[i].Name()), iErr)
+			}
+			if iErr != nil {
+				d.failed.Store(true)
+				errOnce.Do(func() { err = iErr })
+			}
+		})
+	}
+	wg.Wait()
+	if err == nil && d.failed.Load() {
+		// Another directory failed and the tasks of this one were dropped.
+		err = errScanAborted
+	}
+	if err != nil {
+		return "", 0, false, err
+	}
+	entries := make([]*fsmgr.SeafDirent, 0, len(dir))
+	for i, entry := range results {
+		if entry != nil {
+			entries = append(entries, entry)
+			size += sizes[i]
+		}
+	}
+	sort.Sort(fsmgr.Dirents(entries))
+	dirObj, err := fsmgr.NewSeafdir(1, entries)
+	if err != nil {
+		return "", 0, false, err
+	}
+	err = fsmgr.SaveSeafdir(*scanRepoId, dirObj)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if err = d.Mapper.Checkpoint(storePath, dirObj.DirID); err != nil {
+		return "", 0, false, err
+	}
+	d.noteDirUsage(storePath, size)
+	return dirObj.DirID, size, leftOut.Load(), nil
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/blockmgr"
+	"github.com/manx98/local_to_seaf_store/filter"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"go.etcd.io/bbolt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// initScanTest opens a mapping and an object store in a new data dir, which it returns.
+func initScanTest(t *testing.T) string {
+	*scanRepoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	*blockSize = 1024
+	*creator = "me@qq.com"
+	dataDir := t.TempDir()
+	fsmgr.Init(dataDir)
+	if err := virtualfs.InitVirtualFs(filepath.Join(dataDir, "blocks_mapping.db"), false); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(virtualfs.Close)
+	return dataDir
+}
+
+func makeScanTree(t *testing.T) string {
+	root := t.TempDir()
+	for i := 0; i < 8; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("dir%d", i), "sub")
+		if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		for j := 0; j < 8; j++ {
+			data := make([]byte, i*j*300)
+			for k := range data {
+				data[k] = byte(i + j + k)
+			}
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", j)), data, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return root
+}
+
+func TestDirScanner_ParallelMatchesSerial(t *testing.T) {
+	root := makeScanTree(t)
+	var ids []string
+	for _, workers := range []int{1, 8} {
+		initScanTest(t)
+		sc := DirScanner{HashBlocks: true, HashWorkers: 2, Workers: workers}
+		rootId, err := sc.Scan(context.Background(), root, *scanRepoId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sc.Summary.Generated != 64 {
+			t.Fatalf("generated %d files, want 64", sc.Summary.Generated)
+		}
+		ids = append(ids, rootId)
+		virtualfs.Close()
+	}
+	if ids[0] != ids[1] {
+		t.Fatalf("parallel scan root %s differs from serial scan root %s", ids[1], ids[0])
+	}
+}
+
+func TestDirScanner_Incremental(t *testing.T) {
+	root := makeScanTree(t)
+	initScanTest(t)
+	unchanged, changed := *scanRepoId+"/dir2/sub/file3", *scanRepoId+"/dir3/sub/file2"
+	scan := func() (infos []*virtualfs.RealFileInfo, summary ScanSummary) {
+		sc := DirScanner{Incremental: true, Workers: 2}
+		if _, err := sc.Scan(context.Background(), root, *scanRepoId); err != nil {
+			t.Fatal(err)
+		}
+		err := virtualfs.View(func(tx *bbolt.Tx) error {
+			for _, path := range []string{unchanged, changed} {
+				info, err := virtualfs.GetRealFileInfo(tx, []byte(path))
+				if err != nil || info == nil {
+					return fmt.Errorf("info of %s: %v, %w", path, info, err)
+				}
+				infos = append(infos, info)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return infos, sc.Summary
+	}
+	before, _ := scan()
+	if err := os.WriteFile(filepath.Join(root, "dir3/sub/file2"), []byte("changed"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	after, summary := scan()
+	if summary.Reused != 63 || summary.Generated != 1 {
+		t.Errorf("reused %d files, generated %d, want 63 and 1", summary.Reused, summary.Generated)
+	}
+	if before[0].FileID != after[0].FileID || strings.Join(before[0].BlkIDs, ",") != strings.Join(after[0].BlkIDs, ",") {
+		t.Errorf("unchanged file was mapped again: %+v, then %+v", before[0], after[0])
+	}
+	if before[1].FileID == after[1].FileID || after[1].Size != 7 {
+		t.Errorf("changed file was not mapped again: %+v, then %+v", before[1], after[1])
+	}
+	err := virtualfs.View(func(tx *bbolt.Tx) error {
+		for i, info := range append(before, after...) {
+			// Only the old blocks of the changed file are stale.
+			stale := i == 1
+			for _, blkId := range info.BlkIDs {
+				if got := virtualfs.IsStale(tx, virtualfs.ProxyPath(*scanRepoId, blkId)); got != stale {
+					t.Errorf("block %s of %+v is stale %v, want %v", blkId, info, got, stale)
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileBlocks(t, root, unchanged)
+	checkFileBlocks(t, root, changed)
+}
+
+func TestDirScanner_Symlinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(root, "data", "file.txt"), filepath.Join(outside, "secret.txt")} {
+		if err := os.WriteFile(name, []byte("hello"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{
+		"link.txt":  "data/file.txt",
+		"dirlink":   "data",
+		"data/loop": "..",
+		"outside":   filepath.Join(outside, "secret.txt"),
+		"broken":    "nowhere",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tt := range []struct {
+		policy string
+		files  int64
+		// skipped are the skipped links and the start of their reasons.
+		skipped []string
+	}{
+		{SymlinkFollow, 3, []string{"broken=broken link", "data/loop=loop to", "dirlink/loop=loop to", "outside=target outside scan dir"}},
+		{SymlinkSkip, 1, []string{"broken=symlink", "data/loop=symlink", "dirlink=symlink", "link.txt=symlink", "outside=symlink"}},
+		{SymlinkError, 0, nil},
+	} {
+		initScanTest(t)
+		sc := DirScanner{Symlinks: tt.policy, Workers: 1}
+		_, err := sc.Scan(context.Background(), root, *scanRepoId)
+		virtualfs.Close()
+		if tt.policy == SymlinkError {
+			if err == nil || !strings.Contains(err.Error(), "is a symlink") {
+				t.Errorf("%s: scan error %v", tt.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tt.policy, err)
+		}
+		if sc.Summary.Files != tt.files {
+			t.Errorf("%s: scanned %d files, want %d", tt.policy, sc.Summary.Files, tt.files)
+		}
+		ok := len(sc.Summary.SkippedLinks) == len(tt.skipped)
+		for i := 0; ok && i < len(tt.skipped); i++ {
+			entry := sc.Summary.SkippedLinks[i]
+			rel, _ := filepath.Rel(root, entry.Path)
+			ok = strings.HasPrefix(rel+"="+entry.Reason, tt.skipped[i])
+		}
+		if !ok {
+			t.Errorf("%s: skipped links %v, want %v", tt.policy, sc.Summary.SkippedLinks, tt.skipped)
+		}
+	}
+}
+
+func TestDirScanner_SpecialFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int64{"fifo": 2, "socket": 1, "char_device": 1}
+	for _, name := range []string{"fifo1", "fifo2"} {
+		if err := syscall.Mkfifo(filepath.Join(root, name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("unix", filepath.Join(root, "sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// The device of /dev/null, 1:3.
+	if err = syscall.Mknod(filepath.Join(root, "null"), syscall.S_IFCHR|0600, 1<<8|3); err != nil {
+		t.Logf("no device file: %v", err)
+		delete(want, "char_device")
+	}
+	for _, strict := range []bool{false, true} {
+		initScanTest(t)
+		sc := DirScanner{Strict: strict, Workers: 1}
+		_, err = sc.Scan(context.Background(), root, *scanRepoId)
+		virtualfs.Close()
+		if strict {
+			if err == nil || !strings.Contains(err.Error(), "is a special file") {
+				t.Errorf("strict scan error %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sc.Summary.Files != 1 || fmt.Sprint(sc.Summary.SpecialFiles) != fmt.Sprint(want) {
+			t.Errorf("scanned %d files, skipped %v, want 1 and %v", sc.Summary.Files, sc.Summary.SpecialFiles, want)
+		}
+	}
+}
+
+// cancelMapper cancels the scan after n checkpoints.
+type cancelMapper struct {
+	virtualfs.Mapper
+	n      int
+	cancel context.CancelFunc
+}
+
+func (m *cancelMapper) Checkpoint(path string, dirId string) error {
+	if err := m.Mapper.Checkpoint(path, dirId); err != nil {
+		return err
+	}
+	if m.n--; m.n == 0 {
+		m.cancel()
+	}
+	return nil
+}
+
+// takenMapper fails the first n random block ids as taken.
+type takenMapper struct {
+	virtualfs.Mapper
+	n int
+}
+
+func (m *takenMapper) PutFile(repoId string, path string, info *virtualfs.RealFileInfo, blockSize int64, kind byte) error {
+	if kind == virtualfs.ProxyRandom && m.n > 0 {
+		m.n--
+		return syscall.EEXIST
+	}
+	return m.Mapper.PutFile(repoId, path, info, blockSize, kind)
+}
+
+func TestDirScanner_TakenRandomIds(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), make([]byte, 3000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dataDir := initScanTest(t)
+	sc := DirScanner{Workers: 1, Mapper: &takenMapper{Mapper: virtualfs.NewMapper(), n: 2}}
+	rootId, err := sc.Scan(context.Background(), root, *scanRepoId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFileBlocks(t, root, *scanRepoId+"/a.txt")
+	// The objects of the rejected ids are not saved, only those of the file and of the root are.
+	var objects []string
+	err = filepath.WalkDir(filepath.Join(dataDir, "storage", "fs", *scanRepoId), func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			objects = append(objects, filepath.Base(filepath.Dir(path))+d.Name())
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 || (objects[0] != rootId && objects[1] != rootId) {
+		t.Errorf("saved objects %v, want the file and the root %s", objects, rootId)
+	}
+}
+
+func TestDirScanner_Resume(t *testing.T) {
+	root := makeScanTree(t)
+	initScanTest(t)
+	sc := DirScanner{HashBlocks: true, Workers: 1}
+	wantId, err := sc.Scan(context.Background(), root, *scanRepoId)
+	virtualfs.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	initScanTest(t)
+	if err = virtualfs.StartJournal(*scanRepoId, "options", false); err != nil {
+		t.Fatal(err)
+	}
+	// Stopped once dir0 and dir1 are completed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sc = DirScanner{HashBlocks: true, Incremental: true, Workers: 1, Mapper: &cancelMapper{Mapper: virtualfs.NewMapper(), n: 4, cancel: cancel}}
+	if _, err = sc.Scan(ctx, root, *scanRepoId); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled scan returned %v", err)
+	}
+	if sc.Summary.Files != 16 {
+		t.Errorf("cancelled scan went on to %d files", sc.Summary.Files)
+	}
+	if err = virtualfs.StartJournal(*scanRepoId, "other options", true); !errors.Is(err, virtualfs.ErrJournalMismatch) {
+		t.Fatalf("resume with other options returned %v", err)
+	}
+	if err = virtualfs.StartJournal(*scanRepoId, "options", true); err != nil {
+		t.Fatal(err)
+	}
+	sc = DirScanner{HashBlocks: true, Incremental: true, Resume: true, Workers: 1}
+	rootId, err := sc.Scan(context.Background(), root, *scanRepoId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rootId != wantId || sc.Summary.ResumedDirs != 2 || sc.Summary.Generated != 48 {
+		t.Errorf("resumed scan root %s with %d dirs resumed, %d files generated, want %s, 2 and 48",
+			rootId, sc.Summary.ResumedDirs, sc.Summary.Generated, wantId)
+	}
+	// A scan that does not resume starts over.
+	if err = virtualfs.StartJournal(*scanRepoId, "other options", false); err != nil {
+		t.Fatal(err)
+	}
+	if dirId, err := virtualfs.GetCheckpoint(*scanRepoId + "/dir0"); err != nil || dirId != "" {
+		t.Errorf("checkpoint of dir0 after a new start: %q, %v", dirId, err)
+	}
+}
+
+func TestDirScanner_PruneEmptyDirs(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"empty", "logs", "nested/inner", "keep"} {
+		if err := os.MkdirAll(filepath.Join(root, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"logs/a.log", "nested/inner/b.log", "keep/c.txt"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("data"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scanFilter := &filter.Filter{}
+	if err := scanFilter.AddExclude("*.log"); err != nil {
+		t.Fatal(err)
+	}
+	initScanTest(t)
+	sc := DirScanner{Filter: scanFilter, PruneEmptyDirs: true, Workers: 1}
+	rootId, err := sc.Scan(context.Background(), root, *scanRepoId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var paths []string
+	err = fsmgr.Walk(*scanRepoId, rootId, func(entryPath string, dirent *fsmgr.SeafDirent) error {
+		paths = append(paths, entryPath)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The directories that filtering emptied are pruned, also nested ones, the one empty in the source is kept.
+	if got, want := strings.Join(paths, ","), "/keep,/keep/c.txt,/empty"; got != want || sc.Summary.PrunedDirs != 3 {
+		t.Errorf("scanned %s with %d dirs pruned, want %s and 3", got, sc.Summary.PrunedDirs, want)
+	}
+}
+
+func TestDirScanner_Checksums(t *testing.T) {
+	root := makeScanTree(t)
+	initScanTest(t)
+	sc := DirScanner{Checksums: true, Workers: 2}
+	if _, err := sc.Scan(context.Background(), root, *scanRepoId); err != nil {
+		t.Fatal(err)
+	}
+	var sums int64
+	err := virtualfs.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(virtualfs.ChecksumBucketName)).ForEach(func(k, v []byte) error {
+			if len(v) != sha256.Size {
+				return fmt.Errorf("checksum of %s has %d bytes", k, len(v))
+			}
+			sums++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sums != sc.Summary.Blocks {
+		t.Errorf("recorded %d checksums, want one per block: %d", sums, sc.Summary.Blocks)
+	}
+}
+
+// missingChecksums counts the blocks of the scanned files without checksum.
+func missingChecksums(t *testing.T) (missing int) {
+	err := virtualfs.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket([]byte(virtualfs.RealFileInfoBucketName)).ForEach(func(k, v []byte) error {
+			info, err := virtualfs.GetRealFileInfo(tx, k)
+			if err != nil {
+				return err
+			}
+			for _, blkId := range info.BlkIDs {
+				if !virtualfs.HasChecksum(tx, virtualfs.ProxyPath(*scanRepoId, blkId)) {
+					missing++
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestDirScanner_IncrementalChecksums(t *testing.T) {
+	root := makeScanTree(t)
+	initScanTest(t)
+	sc := DirScanner{Incremental: true, HashBlocks: true, Workers: 2}
+	if _, err := sc.Scan(context.Background(), root, *scanRepoId); err != nil {
+		t.Fatal(err)
+	}
+	if missing := missingChecksums(t); missing == 0 {
+		t.Fatal("scan without checksums recorded them")
+	}
+	// Unchanged files are hashed once more for their checksums, and all reused from then on.
+	for pass := 0; pass < 2; pass++ {
+		sc = DirScanner{Incremental: true, HashBlocks: true, Checksums: true, Workers: 2}
+		if _, err := sc.Scan(context.Background(), root, *scanRepoId); err != nil {
+			t.Fatal(err)
+		}
+		if missing := missingChecksums(t); missing != 0 {
+			t.Errorf("pass %d: %d blocks without checksum", pass, missing)
+		}
+		if pass == 0 && sc.Summary.Generated == 0 || pass == 1 && sc.Summary.Reused != 64 {
+			t.Errorf("pass %d: generated %d files, reused %d", pass, sc.Summary.Generated, sc.Summary.Reused)
+		}
+	}
+}
+
+// checkFileBlocks checks that the blocks recorded for storePath are not stale and hold their content.
+func checkFileBlocks(t *testing.T, root string, storePath string) {
+	t.Helper()
+	var info *virtualfs.RealFileInfo
+	err := virtualfs.View(func(tx *bbolt.Tx) (err error) {
+		info, err = virtualfs.GetRealFileInfo(tx, []byte(storePath))
+		return
+	})
+	if err != nil || info == nil {
+		t.Fatalf("info of %s: %v, %v", storePath, info, err)
+	}
+	r := blockmgr.NewResolver(t.TempDir(), *scanRepoId, virtualfs.NewRootResolver(root, nil))
+	for _, blkId := range info.BlkIDs {
+		b, err := r.Resolve(blkId)
+		if err == nil {
+			err = r.Check(b, true)
+		}
+		if err != nil {
+			t.Errorf("block of %s: %v", storePath, err)
+		}
+	}
+}
+
+func TestDirScanner_SharedContentBlocks(t *testing.T) {
+	content := make([]byte, 3000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for _, bulk := range []bool{false, true} {
+		for _, incremental := range []bool{false, true} {
+			for _, changed := range []string{"a", "b"} {
+				root := t.TempDir()
+				for _, name := range []string{"a", "b"} {
+					if err := os.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+				initScanTest(t)
+				scan := func() {
+					sc := DirScanner{HashBlocks: true, Incremental: incremental, Workers: 1}
+					if bulk {
+						sc.Mapper = virtualfs.NewBulkLoader(1000)
+					}
+					if _, err := sc.Scan(context.Background(), root, *scanRepoId); err != nil {
+						t.Fatal(err)
+					}
+				}
+				scan()
+				if err := os.WriteFile(filepath.Join(root, changed), content[:2500], 0644); err != nil {
+					t.Fatal(err)
+				}
+				scan()
+				for _, name := range []string{"a", "b"} {
+					checkFileBlocks(t, root, *scanRepoId+"/"+name)
+				}
+				virtualfs.Close()
+			}
+		}
+	}
+}
+
+// dumpMapping returns the entries of the mapping as "bucket key=value", without the times of directories and stale marks.
+func dumpMapping(t *testing.T) []string {
+	var dump []string
+	err := virtualfs.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				if len(v) == 9 && v[8] == 0 {
+					v = []byte("dir")
+				} else if string(name) == virtualfs.StaleBucketName {
+					v = nil
+				}
+				dump = append(dump, fmt.Sprintf("%s %s=%x", name, k, v))
+				return nil
+			})
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dump
+}
+
+func TestDirScanner_BulkMatchesBatch(t *testing.T) {
+	root := makeScanTree(t)
+	initScanTest(t)
+	virtualfs.Close()
+	// Both mappings are written alternately from the same tree, each to a data dir of its own.
+	dataDirs := []string{t.TempDir(), t.TempDir()}
+	open := func(dataDir string) {
+		fsmgr.Init(dataDir)
+		if err := virtualfs.InitVirtualFs(filepath.Join(dataDir, "blocks_mapping.db"), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for pass := 0; pass < 2; pass++ {
+		for i, dataDir := range dataDirs {
+			open(dataDir)
+			sc := DirScanner{Incremental: true, HashBlocks: true, Checksums: true, Workers: 1}
+			if i == 1 {
+				// Flushed several times during the scan.
+				sc.Mapper = virtualfs.NewBulkLoader(50)
+			}
+			_, err := sc.Scan(context.Background(), root, *scanRepoId)
+			virtualfs.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		// The second pass maps the changed files, and reuses the others.
+		for _, name := range []string{"dir3/sub/file3", "dir6/sub/file6"} {
+			if err := os.WriteFile(filepath.Join(root, name), []byte("changed"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	var dumps []string
+	for _, dataDir := range dataDirs {
+		open(dataDir)
+		dumps = append(dumps, strings.Join(dumpMapping(t), "\n"))
+		virtualfs.Close()
+	}
+	if dumps[0] == "" {
+		t.Fatal("nothing was mapped")
+	}
+	if dumps[0] != dumps[1] {
+		t.Errorf("bulk loaded mapping differs from the batched one:\n%s\n\nbatched:\n%s", dumps[1], dumps[0])
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/commitmgr"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"github.com/manx98/local_to_seaf_store/seafdb"
+	"github.com/manx98/local_to_seaf_store/virtualfs"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var scrubCmd = &cobra.Command{
+	Use:   "scrub",
+	Short: "inspect the background verification of proxy blocks run by mount --scrub-rate",
+}
+
+var scrubStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "list the proxy blocks that failed the scrub with the library files using them",
+	Run:   scrubStatus,
+}
+var scrubDataDir *string
+var scrubJson *bool
+var scrubSeafileDB *string
+var scrubMysqlDSN *string
+var scrubSeafileConf *string
+
+// ScrubProblem is a proxy block that failed the scrub.
+type ScrubProblem struct {
+	Kind    string `json:"kind"`
+	RepoID  string `json:"repo_id"`
+	BlockID string `json:"block_id"`
+	Time    int64  `json:"time"`
+	// Files are the paths of the files of the library head that use the block.
+	Files  []string `json:"files"`
+	Detail string   `json:"detail"`
+}
+
+// ScrubStatus is the report of scrub status.
+type ScrubStatus struct {
+	*virtualfs.ScrubState
+	Problems []*ScrubProblem `json:"problems"`
+}
+
+func formatTime(t int64) string {
+	if t == 0 {
+		return "never"
+	}
+	return time.Unix(t, 0).Format(time.RFC1123Z)
+}
+
+func (s *ScrubStatus) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Passes:\t%d, last completed %s\n", s.Passes, formatTime(s.LastPass))
+	if s.Cursor != "" {
+		fmt.Fprintf(tw, "Current pass:\tstarted %s, %d blocks, %s checked\n", formatTime(s.PassStarted), s.Checked, formatSize(s.CheckedBytes))
+	}
+	fmt.Fprintf(tw, "Problems:\t%d\n", len(s.Problems))
+	for _, p := range s.Problems {
+		files := strings.Join(p.Files, ", ")
+		if files == "" {
+			files = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s/%s\t%s\t%s\n", p.Kind, p.RepoID, p.BlockID, files, p.Detail)
+	}
+	return tw.Flush()
+}
+
+// blockFiles returns the paths of the files of the head of repoID that use the blocks, by block id.
+func blockFiles(db *seafdb.DB, repoID string, blocks map[string]bool) (map[string][]string, error) {
+	head, err := db.GetBranch(context.Background(), repoID, seafdb.MasterBranch)
+	if err != nil {
+		return nil, fmt.Errorf("get branch head: %w", err)
+	}
+	commit, err := commitmgr.Load(repoID, head)
+	if err != nil {
+		return nil, fmt.Errorf("load head commit %s: %w", head, err)
+	}
+	files := make(map[string][]string)
+	err = fsmgr.Walk(repoID, commit.RootID, func(entryPath string, dirent *fsmgr.SeafDirent) error {
+		if fsmgr.IsDir(dirent.Mode) {
+			return nil
+		}
+		file, err := fsmgr.GetSeafile(repoID, dirent.ID)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entryPath, err)
+		}
+		for _, blkID := range file.BlkIDs {
+			if blocks[blkID] {
+				files[blkID] = append(files[blkID], entryPath)
+			}
+		}
+		return nil
+	})
+	return files, err
+}
+
+func scrubStatus(cmd *cobra.Command, args []string) {
+	if *scrubJson {
+		logger.SetLogWriteSyncer(zapcore.Lock(os.Stderr))
+	}
+	report := virtualfs.ScrubReportPath(filepath.Join(*scrubDataDir, "blocks_mapping.db"))
+	state, results, err := virtualfs.ReadScrubReport(report)
+	if err != nil {
+		logger.Fatal("read scrub report occur error", zap.Error(err), zap.String("path", report))
+	}
+	status := &ScrubStatus{ScrubState: state, Problems: make([]*ScrubProblem, 0, len(results))}
+	repos := make(map[string]map[string]bool)
+	for _, result := range results {
+		// Proxy files are /<repo id>/<first two chars of the block id>/<rest of it>.
+		parts := strings.Split(strings.TrimPrefix(result.Path, "/"), "/")
+		if len(parts) != 3 {
+			logger.Warn("invalid proxy path in scrub report", zap.String("path", result.Path))
+			continue
+		}
+		problem := &ScrubProblem{Kind: result.Kind, RepoID: parts[0], BlockID: parts[1] + parts[2], Time: result.Time, Detail: result.Detail}
+		status.Problems = append(status.Problems, problem)
+		if repos[problem.RepoID] == nil {
+			repos[problem.RepoID] = make(map[string]bool)
+		}
+		repos[problem.RepoID][problem.BlockID] = true
+	}
+	if len(repos) > 0 {
+		// Nothing is written by scrub status.
+		commitmgr.InitDryRun(*scrubDataDir)
+		fsmgr.InitDryRun(*scrubDataDir)
+		db := openSeafileDB(*scrubDataDir, *scrubSeafileDB, *scrubMysqlDSN, *scrubSeafileConf)
+		files := make(map[string]map[string][]string, len(repos))
+		for repoID, blocks := range repos {
+			if files[repoID], err = blockFiles(db, repoID, blocks); err != nil {
+				logger.Warn("find files of blocks occur error", zap.Error(err), zap.String("repo_id", repoID))
+			}
+		}
+		db.Close()
+		for _, problem := range status.Problems {
+			problem.Files = files[problem.RepoID][problem.BlockID]
+		}
+	}
+	if *scrubJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(status)
+	} else {
+		err = status.WriteText(os.Stdout)
+	}
+	if err != nil {
+		logger.Fatal("write scrub status occur error", zap.Error(err))
+	}
+}
@@ -51,21 +51,28 @@ func Init(dataDir string) {
 	store = objstore.New(dataDir, "commits")
 }
 
+// InitDryRun initializes commit manager without writing to dataDir, saved commits are kept in memory.
+func InitDryRun(dataDir string) {
+	store = objstore.NewScratch(dataDir, "commits")
+}
+
 // NewCommit initializes a Commit object.
+// Without parent the caller sets RepoID, RepoName and Version, see NewInitialCommit.
 func NewCommit(parent *Commit, newRoot, user, desc string) *Commit {
 	commit := new(Commit)
-	commit.RepoID = parent.RepoID
 	commit.RootID = newRoot
 	commit.Desc = desc
 	commit.CreatorName = user
 	commit.CreatorID = "0000000000000000000000000000000000000000"
 	commit.Ctime = time.Now().Unix()
 	commit.CommitID = computeCommitID(commit)
-	if parent != nil {
-		commit.ParentID.SetValid(parent.CommitID)
+	if parent == nil {
+		return commit
 	}
-
+	commit.ParentID.SetValid(parent.CommitID)
+	commit.RepoID = parent.RepoID
 	commit.RepoName = parent.RepoName
+	commit.RepoDesc = parent.RepoDesc
 	commit.Encrypted = parent.Encrypted
 	if parent.Encrypted == "true" {
 		commit.EncVersion = parent.EncVersion
@@ -94,6 +101,16 @@ func NewCommit(parent *Commit, newRoot, user, desc string) *Commit {
 	return commit
 }
 
+// NewInitialCommit initializes the first commit of a new unencrypted library, as Seafile creates it.
+func NewInitialCommit(repoID, name, desc, user string) *Commit {
+	commit := NewCommit(nil, "0000000000000000000000000000000000000000", user, "Created library")
+	commit.RepoID = repoID
+	commit.RepoName = name
+	commit.RepoDesc = desc
+	commit.Version = 1
+	return commit
+}
+
 func computeCommitID(commit *Commit) string {
 	hash := sha1.New()
 	hash.Write([]byte(commit.RootID))
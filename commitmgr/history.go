@@ -0,0 +1,82 @@
+package commitmgr
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// StopWalk is returned by a HistoryFunc to end WalkHistory without an error.
+var StopWalk = errors.New("stop walking history")
+
+// HistoryFunc is called by WalkHistory for every commit reached.
+type HistoryFunc func(commit *Commit) error
+
+// commitQueue orders the commits to visit newest first.
+type commitQueue []*Commit
+
+func (q commitQueue) Len() int           { return len(q) }
+func (q commitQueue) Less(i, j int) bool { return q[i].Ctime > q[j].Ctime }
+func (q commitQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)        { *q = append(*q, x.(*Commit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	c := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return c
+}
+
+// WalkHistory calls fn for every commit reachable from heads through ParentID and SecondParentID,
+// newest first and each commit once.
+func WalkHistory(repoID string, heads []string, fn HistoryFunc) error {
+	seen := make(map[string]bool)
+	var queue commitQueue
+	push := func(commitID string) error {
+		if seen[commitID] {
+			return nil
+		}
+		seen[commitID] = true
+		commit, err := Load(repoID, commitID)
+		if err != nil {
+			return err
+		}
+		heap.Push(&queue, commit)
+		return nil
+	}
+	for _, head := range heads {
+		if err := push(head); err != nil {
+			return err
+		}
+	}
+	for queue.Len() > 0 {
+		commit := heap.Pop(&queue).(*Commit)
+		if err := fn(commit); err != nil {
+			if errors.Is(err, StopWalk) {
+				return nil
+			}
+			return err
+		}
+		for _, parent := range []String{commit.ParentID, commit.SecondParentID} {
+			if !parent.Valid {
+				continue
+			}
+			if err := push(parent.String); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReachableRoots returns the root ids of the commits reachable from heads, each once.
+func ReachableRoots(repoID string, heads ...string) ([]string, error) {
+	var roots []string
+	seen := make(map[string]bool)
+	err := WalkHistory(repoID, heads, func(commit *Commit) error {
+		if !seen[commit.RootID] {
+			seen[commit.RootID] = true
+			roots = append(roots, commit.RootID)
+		}
+		return nil
+	})
+	return roots, err
+}
@@ -0,0 +1,62 @@
+package commitmgr
+
+import (
+	"strings"
+	"testing"
+)
+
+const testRepoID = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+
+func saveTestCommit(t *testing.T, parents []*Commit, root string, ctime int64) *Commit {
+	var parent *Commit
+	if len(parents) > 0 {
+		parent = parents[0]
+	}
+	commit := NewCommit(parent, root, "me@example.com", "test")
+	commit.RepoID = testRepoID
+	commit.Ctime = ctime
+	if len(parents) > 1 {
+		commit.SecondParentID.SetValid(parents[1].CommitID)
+	}
+	commit.CommitID = computeCommitID(commit)
+	if err := Save(commit); err != nil {
+		t.Fatal(err)
+	}
+	return commit
+}
+
+func TestWalkHistory(t *testing.T) {
+	Init(t.TempDir())
+	rootA := strings.Repeat("a", 40)
+	rootB := strings.Repeat("b", 40)
+	base := saveTestCommit(t, nil, rootA, 1)
+	left := saveTestCommit(t, []*Commit{base}, rootB, 2)
+	right := saveTestCommit(t, []*Commit{base}, rootA, 3)
+	merge := saveTestCommit(t, []*Commit{left, right}, rootB, 4)
+	var got []string
+	err := WalkHistory(testRepoID, []string{merge.CommitID}, func(commit *Commit) error {
+		got = append(got, commit.CommitID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{merge.CommitID, right.CommitID, left.CommitID, base.CommitID}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("walked %v, want %v", got, want)
+	}
+	roots, err := ReachableRoots(testRepoID, merge.CommitID)
+	if err != nil || len(roots) != 2 || roots[0] != rootB || roots[1] != rootA {
+		t.Errorf("reachable roots %v, error %v", roots, err)
+	}
+	var n int
+	err = WalkHistory(testRepoID, []string{merge.CommitID}, func(*Commit) error {
+		if n++; n == 2 {
+			return StopWalk
+		}
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Errorf("stopped after %d commits, error %v", n, err)
+	}
+}
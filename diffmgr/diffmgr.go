@@ -0,0 +1,190 @@
+// Package diffmgr compares fs trees of a library.
+package diffmgr
+
+import (
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Status is how an entry changed.
+type Status string
+
+const (
+	Added    Status = "added"
+	Deleted  Status = "deleted"
+	Modified Status = "modified"
+	// Renamed entries have the same id at a new path.
+	Renamed Status = "renamed"
+)
+
+// Change is a changed entry. The size of a directory is the size of the files in it.
+type Change struct {
+	Status Status `json:"status"`
+	Path   string `json:"path"`
+	// OldPath is the path before a rename.
+	OldPath   string `json:"old_path,omitempty"`
+	Dir       bool   `json:"dir"`
+	OldSize   int64  `json:"old_size"`
+	Size      int64  `json:"size"`
+	SizeDelta int64  `json:"size_delta"`
+	// id is the id of an added or deleted entry, empty for the empty file and directory.
+	id      string
+	removed bool
+}
+
+// Diff returns the changes from the tree from to the tree to. Subtrees with the same id are skipped.
+// The changes are in the order of a walk of both trees, the entries of an added or deleted directory follow it.
+func Diff(repoID string, from string, to string) ([]*Change, error) {
+	d := &differ{repoID: repoID}
+	if err := d.diffDir("/", from, to); err != nil {
+		return nil, err
+	}
+	d.findRenames()
+	changes := make([]*Change, 0, len(d.changes))
+	for _, c := range d.changes {
+		if !c.removed {
+			changes = append(changes, c)
+		}
+	}
+	return changes, nil
+}
+
+type differ struct {
+	repoID  string
+	changes []*Change
+}
+
+func entryMap(dir *fsmgr.SeafDir) map[string]*fsmgr.SeafDirent {
+	entries := make(map[string]*fsmgr.SeafDirent, len(dir.Entries))
+	for _, entry := range dir.Entries {
+		entries[entry.Name] = entry
+	}
+	return entries
+}
+
+func (d *differ) diffDir(dirPath string, from string, to string) error {
+	if from == to {
+		return nil
+	}
+	var dirs [2]map[string]*fsmgr.SeafDirent
+	names := make(map[string]bool)
+	for i, id := range []string{from, to} {
+		dir, err := fsmgr.GetSeafdir(d.repoID, id)
+		if err != nil {
+			return err
+		}
+		dirs[i] = entryMap(dir)
+		for name := range dirs[i] {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		f, t := dirs[0][name], dirs[1][name]
+		entryPath := path.Join(dirPath, name)
+		var err error
+		switch {
+		case f != nil && t != nil && fsmgr.IsDir(f.Mode) && fsmgr.IsDir(t.Mode):
+			err = d.diffDir(entryPath, f.ID, t.ID)
+		case f != nil && t != nil && !fsmgr.IsDir(f.Mode) && !fsmgr.IsDir(t.Mode):
+			if f.ID != t.ID {
+				d.changes = append(d.changes, &Change{Status: Modified, Path: entryPath, OldSize: f.Size, Size: t.Size, SizeDelta: t.Size - f.Size})
+			}
+		default:
+			// A file replaced by a directory, or the other way around, is deleted and added.
+			if f != nil {
+				if err = d.entry(Deleted, entryPath, f); err != nil {
+					return err
+				}
+			}
+			if t != nil {
+				err = d.entry(Added, entryPath, t)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// entry records an added or deleted entry, and all the entries in it for a directory.
+func (d *differ) entry(status Status, entryPath string, dirent *fsmgr.SeafDirent) error {
+	c := &Change{Status: status, Path: entryPath, Dir: fsmgr.IsDir(dirent.Mode)}
+	if dirent.ID != fsmgr.EmptySha1 {
+		c.id = dirent.ID
+	}
+	d.changes = append(d.changes, c)
+	size := dirent.Size
+	if c.Dir {
+		first := len(d.changes)
+		var err error
+		if status == Added {
+			err = d.diffDir(entryPath, fsmgr.EmptySha1, dirent.ID)
+		} else {
+			err = d.diffDir(entryPath, dirent.ID, fsmgr.EmptySha1)
+		}
+		if err != nil {
+			return err
+		}
+		size = 0
+		for _, sub := range d.changes[first:] {
+			if !sub.Dir {
+				size += sub.Size + sub.OldSize
+			}
+		}
+	}
+	if status == Added {
+		c.Size, c.SizeDelta = size, size
+	} else {
+		c.OldSize, c.SizeDelta = size, -size
+	}
+	return nil
+}
+
+// findRenames pairs deleted and added entries with the same id, directories first.
+// The entries in a renamed directory are dropped, they did not change.
+func (d *differ) findRenames() {
+	for _, dirs := range []bool{true, false} {
+		deleted := make(map[string][]*Change)
+		for _, c := range d.changes {
+			if c.Status == Deleted && c.Dir == dirs && !c.removed && c.id != "" {
+				deleted[c.id] = append(deleted[c.id], c)
+			}
+		}
+		for _, c := range d.changes {
+			if c.Status != Added || c.Dir != dirs || c.removed {
+				continue
+			}
+			// Entries in a directory renamed meanwhile are already dropped.
+			for len(deleted[c.id]) > 0 && deleted[c.id][0].removed {
+				deleted[c.id] = deleted[c.id][1:]
+			}
+			if len(deleted[c.id]) == 0 {
+				continue
+			}
+			old := deleted[c.id][0]
+			deleted[c.id] = deleted[c.id][1:]
+			old.removed = true
+			c.Status, c.OldPath, c.OldSize, c.SizeDelta = Renamed, old.Path, c.Size, 0
+			if dirs {
+				d.removeUnder(old.Path, Deleted)
+				d.removeUnder(c.Path, Added)
+			}
+		}
+	}
+}
+
+func (d *differ) removeUnder(dirPath string, status Status) {
+	for _, c := range d.changes {
+		if c.Status == status && strings.HasPrefix(c.Path, dirPath+"/") {
+			c.removed = true
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package diffmgr
+
+import (
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const testRepoID = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+
+// makeTree saves a tree of files of 1 byte given as path to file id and returns its root id.
+func makeTree(t *testing.T, files map[string]string) string {
+	children := make(map[string]map[string]string)
+	for p, id := range files {
+		dir, name := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		if children[dir] == nil {
+			children[dir] = make(map[string]string)
+		}
+		children[dir][name] = id
+		for dir != "" {
+			parent, name := path.Split(dir)
+			parent = strings.TrimSuffix(parent, "/")
+			if children[parent] == nil {
+				children[parent] = make(map[string]string)
+			}
+			children[parent][name+"/"] = ""
+			dir = parent
+		}
+	}
+	var save func(dir string) string
+	save = func(dir string) string {
+		var entries []*fsmgr.SeafDirent
+		for name, id := range children[dir] {
+			if strings.HasSuffix(name, "/") {
+				name = strings.TrimSuffix(name, "/")
+				entries = append(entries, fsmgr.NewDirent(save(path.Join(dir, name)), name, syscall.S_IFDIR|0644, 1, "", 0))
+			} else {
+				entries = append(entries, fsmgr.NewDirent(id, name, syscall.S_IFREG|0644, 1, "me", 1))
+			}
+		}
+		sort.Sort(fsmgr.Dirents(entries))
+		seafdir, err := fsmgr.NewSeafdir(1, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fsmgr.SaveSeafdir(testRepoID, seafdir); err != nil {
+			t.Fatal(err)
+		}
+		return seafdir.DirID
+	}
+	return save("")
+}
+
+const (
+	idA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	idB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	idC = "cccccccccccccccccccccccccccccccccccccccc"
+	idD = "dddddddddddddddddddddddddddddddddddddddd"
+)
+
+func TestDiff(t *testing.T) {
+	fsmgr.Init(t.TempDir())
+	from := makeTree(t, map[string]string{"keep": idA, "docs/edit": idA, "docs/gone": idB, "old/x": idA, "old/y": idB, "mv": idC})
+	to := makeTree(t, map[string]string{"keep": idA, "docs/edit": idB, "new/x": idA, "new/y": idB, "moved": idC, "add/d": idD})
+	changes, err := Diff(testRepoID, from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range changes {
+		s := string(c.Status) + " " + c.Path
+		if c.OldPath != "" {
+			s += " from " + c.OldPath
+		}
+		got = append(got, s)
+		if c.Path == "/add" && (!c.Dir || c.SizeDelta != 1) {
+			t.Errorf("added dir %+v", c)
+		}
+	}
+	want := []string{"added /add", "added /add/d", "modified /docs/edit", "deleted /docs/gone", "renamed /moved from /mv", "renamed /new from /old"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if changes, err = Diff(testRepoID, from, from); err != nil || len(changes) != 0 {
+		t.Errorf("diff of a tree with itself returned %v, %v", changes, err)
+	}
+}
@@ -0,0 +1,166 @@
+// Package filter decides which entries of a scanned tree go into the library.
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+type rule struct {
+	pattern string
+	re      *regexp.Regexp
+	negate  bool
+	dirOnly bool
+}
+
+// Filter holds gitignore-style rules and the size and depth limits of a scan.
+// Rules are evaluated in the order they were added and the last matching rule wins.
+type Filter struct {
+	rules []rule
+	// MinSize excludes files smaller than it.
+	MinSize int64
+	// MaxSize excludes files larger than it when greater than 0.
+	MaxSize int64
+	// MaxDepth excludes entries nested deeper than it when greater than 0, entries of the scan root have depth 1.
+	MaxDepth int
+}
+
+// AddExclude adds a gitignore pattern, a leading '!' turns it into an include rule.
+func (f *Filter) AddExclude(pattern string) error {
+	r, err := compile(pattern)
+	if err != nil {
+		return err
+	}
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+// AddInclude adds a pattern that re-includes the paths excluded by the rules before it.
+func (f *Filter) AddInclude(pattern string) error {
+	r, err := compile(pattern)
+	if err != nil {
+		return err
+	}
+	r.negate = !r.negate
+	f.rules = append(f.rules, r)
+	return nil
+}
+
+// AddExcludeFrom adds the rules of a gitignore file.
+func (f *Filter) AddExcludeFrom(file string) error {
+	fd, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	scanner := bufio.NewScanner(fd)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimRight(scanner.Text(), "\r")
+		// Trailing spaces are ignored unless they are escaped.
+		for strings.HasSuffix(text, " ") && !strings.HasSuffix(text, "\\ ") {
+			text = text[:len(text)-1]
+		}
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if err = f.AddExclude(text); err != nil {
+			return fmt.Errorf("%s:%d: %w", file, line, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Excluded reports whether the rules exclude path, a slash separated path relative to the scan root.
+func (f *Filter) Excluded(path string, isDir bool) bool {
+	excluded := false
+	for i := range f.rules {
+		r := &f.rules[i]
+		if r.dirOnly && !isDir {
+			continue
+		}
+		if r.re.MatchString(path) {
+			excluded = !r.negate
+		}
+	}
+	return excluded
+}
+
+// SizeExcluded reports whether a file of size is out of the size limits.
+func (f *Filter) SizeExcluded(size int64) bool {
+	return size < f.MinSize || (f.MaxSize > 0 && size > f.MaxSize)
+}
+
+// DepthExcluded reports whether an entry at depth is nested too deep.
+func (f *Filter) DepthExcluded(depth int) bool {
+	return f.MaxDepth > 0 && depth > f.MaxDepth
+}
+
+func compile(pattern string) (r rule, err error) {
+	r.pattern = pattern
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\!") || strings.HasPrefix(pattern, "\\#") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	if pattern == "" {
+		return r, fmt.Errorf("invalid pattern %q", r.pattern)
+	}
+	// A pattern without a slash matches at any depth, otherwise it is relative to the scan root.
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	var buf strings.Builder
+	buf.WriteByte('^')
+	if !anchored {
+		buf.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			buf.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			buf.WriteString("/.*")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			buf.WriteString(".*")
+			i++
+		case c == '*':
+			buf.WriteString("[^/]*")
+		case c == '?':
+			buf.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return r, fmt.Errorf("invalid pattern %q: unterminated [", r.pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			buf.WriteString("[" + strings.ReplaceAll(class, "\\", "\\\\") + "]")
+			i += end + 1
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			buf.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			buf.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	buf.WriteByte('$')
+	r.re, err = regexp.Compile(buf.String())
+	if err != nil {
+		return r, fmt.Errorf("invalid pattern %q: %w", r.pattern, err)
+	}
+	return r, nil
+}
@@ -0,0 +1,57 @@
+package filter
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFilter_Excluded(t *testing.T) {
+	f := &Filter{}
+	for _, p := range []string{"lost+found/", ".snapshot", "*.tmp", "/top.iso", "logs/**/*.log", "data/*"} {
+		if err := f.AddExclude(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.AddInclude("data/keep"); err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path     string
+		isDir    bool
+		excluded bool
+	}{
+		{"lost+found", true, true},
+		{"lost+found", false, false},
+		{"a/b/.snapshot", true, true},
+		{"a/b/c.tmp", false, true},
+		{"a/b/c.tmpx", false, false},
+		{"top.iso", false, true},
+		{"a/top.iso", false, false},
+		{"logs/x.log", false, true},
+		{"logs/a/b/x.log", false, true},
+		{"other/x.log", false, false},
+		{"data/other", false, true},
+		{"data/keep", true, false},
+	}
+	for _, c := range cases {
+		if got := f.Excluded(c.path, c.isDir); got != c.excluded {
+			t.Errorf("Excluded(%q, %v) = %v, want %v", c.path, c.isDir, got, c.excluded)
+		}
+	}
+}
+
+func TestFilter_AddExcludeFrom(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ignore")
+	err := os.WriteFile(file, []byte("# comment\n\n*.iso\n!keep.iso\n\\#hash\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Filter{}
+	if err = f.AddExcludeFrom(file); err != nil {
+		t.Fatal(err)
+	}
+	if !f.Excluded("a/big.iso", false) || f.Excluded("a/keep.iso", false) || !f.Excluded("#hash", false) {
+		t.Fatal("unexpected result of rules from file")
+	}
+}
@@ -17,6 +17,9 @@ var json = jsoniter.ConfigCompatibleWithStandardLibrary
 
 var store *objstore.ObjectStore
 
+// discardFiles drops file objects instead of saving them, set for dry runs.
+var discardFiles bool
+
 // Dirents is an alias for slice of SeafDirent.
 type Dirents []*SeafDirent
 
@@ -33,6 +36,15 @@ func (d Dirents) Len() int {
 
 func Init(dataDir string) {
 	store = objstore.New(dataDir, "fs")
+	cache = newObjectCache(cache.size)
+}
+
+// InitDryRun initializes fs manager without writing to dataDir, dir objects are kept in memory
+// and file objects are discarded.
+func InitDryRun(dataDir string) {
+	store = objstore.NewScratch(dataDir, "fs")
+	discardFiles = true
+	cache = newObjectCache(cache.size)
 }
 
 // Seafile is a file object
@@ -278,6 +290,15 @@ func NewSeafdir(version int, entries []*SeafDirent) (*SeafDir, error) {
 		dir.DirID = EmptySha1
 		return dir, nil
 	}
+	if version == 0 {
+		data, err := dir.toV0()
+		if err != nil {
+			return nil, fmt.Errorf("convert seafdir to v0: %w", err)
+		}
+		dir.data = data
+		dir.DirID = v0DirID(entries)
+		return dir, nil
+	}
 	jsonstr, err := dir.toJSON()
 	if err != nil {
 		return nil, fmt.Errorf("convert seafdir to json: %w", err)
@@ -300,6 +321,15 @@ func NewSeafile(version int, fileSize int64, blkIDs []string) (*Seafile, error)
 		return seafile, nil
 	}
 
+	if version == 0 {
+		data, err := seafile.toV0()
+		if err != nil {
+			return nil, err
+		}
+		seafile.data = data
+		seafile.FileID = v0FileID(data)
+		return seafile, nil
+	}
 	jsonstr, err := seafile.toJSON()
 	if err != nil {
 		err := fmt.Errorf("failed to convert seafile to json")
@@ -328,13 +358,17 @@ func compress(p []byte) ([]byte, error) {
 }
 
 // ToData converts seafile to JSON-encoded data and writes to w.
+// Version 0 objects are written in the uncompressed binary format.
 func (f *Seafile) ToData(w io.Writer) error {
-	buf, err := compress(f.data)
-	if err != nil {
-		return err
+	buf := f.data
+	if f.Version > 0 {
+		var err error
+		if buf, err = compress(f.data); err != nil {
+			return err
+		}
 	}
 
-	_, err = w.Write(buf)
+	_, err := w.Write(buf)
 	if err != nil {
 		return err
 	}
@@ -343,13 +377,17 @@ func (f *Seafile) ToData(w io.Writer) error {
 }
 
 // ToData converts seafdir to JSON-encoded data and writes to w.
+// Version 0 objects are written in the uncompressed binary format.
 func (d *SeafDir) ToData(w io.Writer) error {
-	buf, err := compress(d.data)
-	if err != nil {
-		return err
+	buf := d.data
+	if d.Version > 0 {
+		var err error
+		if buf, err = compress(d.data); err != nil {
+			return err
+		}
 	}
 
-	_, err = w.Write(buf)
+	_, err := w.Write(buf)
 	if err != nil {
 		return err
 	}
@@ -369,7 +407,7 @@ func WriteRaw(repoID string, objID string, r io.Reader) error {
 // SaveSeafile saves seafile to storage backend.
 func SaveSeafile(repoID string, seafile *Seafile) error {
 	fileID := seafile.FileID
-	if fileID == EmptySha1 {
+	if fileID == EmptySha1 || discardFiles {
 		return nil
 	}
 
@@ -427,3 +465,17 @@ func SaveSeafdir(repoID string, seafdir *SeafDir) error {
 func IsRegular(m uint32) bool {
 	return (m & syscall.S_IFMT) == syscall.S_IFREG
 }
+
+// Exists checks whether the fs object exists in storage backend.
+func Exists(repoID string, objID string) bool {
+	if objID == EmptySha1 {
+		return true
+	}
+	exist, _ := store.Exists(repoID, objID)
+	return exist
+}
+
+// IsDir Check if the mode is dir.
+func IsDir(m uint32) bool {
+	return (m & syscall.S_IFMT) == syscall.S_IFDIR
+}
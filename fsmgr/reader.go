@@ -0,0 +1,355 @@
+package fsmgr
+
+import (
+	"bytes"
+	"compress/zlib"
+	"container/list"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+)
+
+// The version 0 objects are the binary structs of Seafile in network byte order, stored uncompressed:
+//
+//	file: uint32 type, uint64 size, then 20 bytes of every block id
+//	dir:  uint32 type, then per entry uint32 mode, 40 hex chars id, uint32 name length, name
+const (
+	v0FileHeaderSize   = 12
+	v0DirHeaderSize    = 4
+	v0DirentHeaderSize = 48
+)
+
+func (f *Seafile) toV0() ([]byte, error) {
+	buf := make([]byte, v0FileHeaderSize, v0FileHeaderSize+len(f.BlkIDs)*20)
+	binary.BigEndian.PutUint32(buf, SeafMetadataTypeFile)
+	binary.BigEndian.PutUint64(buf[4:], f.FileSize)
+	for _, blkID := range f.BlkIDs {
+		id, err := hex.DecodeString(blkID)
+		if err != nil || len(id) != 20 {
+			return nil, fmt.Errorf("invalid block id %q", blkID)
+		}
+		buf = append(buf, id...)
+	}
+	return buf, nil
+}
+
+func (d *SeafDir) toV0() ([]byte, error) {
+	buf := binary.BigEndian.AppendUint32(nil, SeafMetadataTypeDir)
+	for _, dent := range d.Entries {
+		if len(dent.ID) != 40 {
+			return nil, fmt.Errorf("invalid dirent id %q", dent.ID)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, dent.Mode)
+		buf = append(buf, dent.ID...)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(dent.Name)))
+		buf = append(buf, dent.Name...)
+	}
+	return buf, nil
+}
+
+// The ids of version 0 objects are not the SHA-1 of their data. The id of a file is the SHA-1 of its block ids,
+// the id of a dir the SHA-1 of the id, the name and the little-endian mode of every entry.
+
+func v0FileID(data []byte) string {
+	sum := sha1.Sum(data[v0FileHeaderSize:])
+	return hex.EncodeToString(sum[:])
+}
+
+func v0DirID(entries []*SeafDirent) string {
+	h := sha1.New()
+	for _, dent := range entries {
+		h.Write([]byte(dent.ID))
+		h.Write([]byte(dent.Name))
+		h.Write(binary.LittleEndian.AppendUint32(nil, dent.Mode))
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// v0ObjectID returns the id of the version 0 object data.
+func v0ObjectID(data []byte) (string, error) {
+	switch binary.BigEndian.Uint32(data) {
+	case SeafMetadataTypeFile:
+		if _, err := seafileFromV0(data); err != nil {
+			return "", err
+		}
+		return v0FileID(data), nil
+	case SeafMetadataTypeDir:
+		d, err := seafdirFromV0(data)
+		if err != nil {
+			return "", err
+		}
+		return v0DirID(d.Entries), nil
+	}
+	return "", errors.New("invalid v0 object type")
+}
+
+// isV0 reports whether data is a version 0 object, which starts with its type instead of a zlib header.
+func isV0(data []byte) bool {
+	return len(data) >= 4 && data[0] == 0
+}
+
+func seafileFromV0(data []byte) (*Seafile, error) {
+	if len(data) < v0FileHeaderSize || (len(data)-v0FileHeaderSize)%20 != 0 ||
+		binary.BigEndian.Uint32(data) != SeafMetadataTypeFile {
+		return nil, errors.New("invalid v0 seafile")
+	}
+	f := &Seafile{Version: 0, FileType: SeafMetadataTypeFile, FileSize: binary.BigEndian.Uint64(data[4:])}
+	for ids := data[v0FileHeaderSize:]; len(ids) > 0; ids = ids[20:] {
+		f.BlkIDs = append(f.BlkIDs, hex.EncodeToString(ids[:20]))
+	}
+	return f, nil
+}
+
+func seafdirFromV0(data []byte) (*SeafDir, error) {
+	if len(data) < v0DirHeaderSize || binary.BigEndian.Uint32(data) != SeafMetadataTypeDir {
+		return nil, errors.New("invalid v0 seafdir")
+	}
+	d := &SeafDir{Version: 0, DirType: SeafMetadataTypeDir}
+	for rest := data[v0DirHeaderSize:]; len(rest) > 0; {
+		if len(rest) < v0DirentHeaderSize {
+			return nil, errors.New("invalid v0 dirent")
+		}
+		nameLen := int(binary.BigEndian.Uint32(rest[44:]))
+		if len(rest) < v0DirentHeaderSize+nameLen {
+			return nil, errors.New("invalid v0 dirent name")
+		}
+		d.Entries = append(d.Entries, &SeafDirent{
+			Mode: binary.BigEndian.Uint32(rest),
+			ID:   string(rest[4:44]),
+			Name: string(rest[v0DirentHeaderSize : v0DirentHeaderSize+nameLen]),
+		})
+		rest = rest[v0DirentHeaderSize+nameLen:]
+	}
+	return d, nil
+}
+
+func uncompress(p []byte) ([]byte, error) {
+	r, err := zlib.NewReader(bytes.NewReader(p))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// readObject reads an fs object and returns its decoded data, JSON for version 1 and binary for version 0.
+func readObject(repoID string, objID string) (data []byte, v0 bool, err error) {
+	var buf bytes.Buffer
+	if err = store.Read(repoID, objID, &buf); err != nil {
+		return nil, false, err
+	}
+	if isV0(buf.Bytes()) {
+		return buf.Bytes(), true, nil
+	}
+	data, err = uncompress(buf.Bytes())
+	return data, false, err
+}
+
+// GetSeafile gets seafile object from storage backend.
+// The object is shared with the cache and must not be modified.
+func GetSeafile(repoID string, fileID string) (*Seafile, error) {
+	if fileID == EmptySha1 {
+		return &Seafile{Version: 1, FileType: SeafMetadataTypeFile, FileID: EmptySha1}, nil
+	}
+	if obj, ok := cache.get(repoID, fileID); ok {
+		if f, ok := obj.(*Seafile); ok {
+			return f, nil
+		}
+	}
+	data, v0, err := readObject(repoID, fileID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seafile object %s/%s: %w", repoID, fileID, err)
+	}
+	var f *Seafile
+	if v0 {
+		f, err = seafileFromV0(data)
+	} else {
+		f = new(Seafile)
+		err = json.Unmarshal(data, f)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode seafile object %s/%s: %w", repoID, fileID, err)
+	}
+	if f.FileType != SeafMetadataTypeFile {
+		return nil, fmt.Errorf("object %s/%s is not a seafile", repoID, fileID)
+	}
+	f.data = data
+	f.FileID = fileID
+	cache.put(repoID, fileID, f)
+	return f, nil
+}
+
+// GetSeafdir gets seafdir object from storage backend.
+// The object is shared with the cache and must not be modified.
+func GetSeafdir(repoID string, dirID string) (*SeafDir, error) {
+	if dirID == EmptySha1 {
+		return &SeafDir{Version: 1, DirType: SeafMetadataTypeDir, DirID: EmptySha1}, nil
+	}
+	if obj, ok := cache.get(repoID, dirID); ok {
+		if d, ok := obj.(*SeafDir); ok {
+			return d, nil
+		}
+	}
+	data, v0, err := readObject(repoID, dirID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seafdir object %s/%s: %w", repoID, dirID, err)
+	}
+	var d *SeafDir
+	if v0 {
+		d, err = seafdirFromV0(data)
+	} else {
+		d = new(SeafDir)
+		err = json.Unmarshal(data, d)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode seafdir object %s/%s: %w", repoID, dirID, err)
+	}
+	if d.DirType != SeafMetadataTypeDir {
+		return nil, fmt.Errorf("object %s/%s is not a seafdir", repoID, dirID)
+	}
+	d.data = data
+	d.DirID = dirID
+	cache.put(repoID, dirID, d)
+	return d, nil
+}
+
+// SkipDir is returned by a WalkFunc to skip the directory it was called for,
+// or the remaining entries of the parent directory if it was called for a file.
+var SkipDir = errors.New("skip this directory")
+
+// WalkFunc is called by Walk for every entry of the tree, dirPath is the path of the entry from the root, e.g. "/a/b".
+type WalkFunc func(dirPath string, dirent *SeafDirent) error
+
+// Walk calls fn for every entry of the tree rootID, a directory before its entries.
+// The entries of a directory are visited in the order they are stored.
+func Walk(repoID string, rootID string, fn WalkFunc) error {
+	return walk(repoID, "/", rootID, fn)
+}
+
+func walk(repoID string, dirPath string, dirID string, fn WalkFunc) error {
+	dir, err := GetSeafdir(repoID, dirID)
+	if err != nil {
+		return err
+	}
+	for _, entry := range dir.Entries {
+		entryPath := path.Join(dirPath, entry.Name)
+		err = fn(entryPath, entry)
+		if errors.Is(err, SkipDir) {
+			if IsDir(entry.Mode) {
+				continue
+			}
+			return nil
+		}
+		if err == nil && IsDir(entry.Mode) {
+			err = walk(repoID, entryPath, entry.ID, fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DefaultCacheSize is the number of objects kept by the object cache.
+const DefaultCacheSize = 4096
+
+var cache = newObjectCache(DefaultCacheSize)
+
+// SetCacheSize sets the number of objects kept by the object cache, 0 disables it.
+func SetCacheSize(size int) {
+	cache.resize(size)
+}
+
+type cacheEntry struct {
+	key string
+	obj any
+}
+
+// objectCache is an LRU cache of decoded fs objects, which never change once written.
+type objectCache struct {
+	mu    sync.Mutex
+	size  int
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newObjectCache(size int) *objectCache {
+	return &objectCache{size: size, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *objectCache) get(repoID string, objID string) (any, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[repoID+objID]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry).obj, true
+}
+
+func (c *objectCache) put(repoID string, objID string, obj any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := repoID + objID
+	if e, ok := c.items[key]; ok {
+		c.order.MoveToFront(e)
+		return
+	}
+	if c.size <= 0 {
+		return
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, obj: obj})
+	c.evict()
+}
+
+func (c *objectCache) resize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.size = size
+	c.evict()
+}
+
+func (c *objectCache) evict() {
+	for c.order.Len() > max(c.size, 0) {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.items, e.Value.(*cacheEntry).key)
+	}
+}
+
+// ErrObjectCorrupt is returned when an fs object can not be decoded or does not hash to its id.
+var ErrObjectCorrupt = errors.New("fs object is corrupt")
+
+// VerifyObject checks that the fs object exists and hashes to its id.
+// A missing object fails with an error matching fs.ErrNotExist.
+func VerifyObject(repoID string, objID string) error {
+	if objID == EmptySha1 {
+		return nil
+	}
+	data, v0, err := readObject(repoID, objID)
+	if errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%s: %w: %v", objID, ErrObjectCorrupt, err)
+	}
+	var id string
+	if v0 {
+		if id, err = v0ObjectID(data); err != nil {
+			return fmt.Errorf("%s: %w: %v", objID, ErrObjectCorrupt, err)
+		}
+	} else {
+		sum := sha1.Sum(data)
+		id = hex.EncodeToString(sum[:])
+	}
+	if id != objID {
+		return fmt.Errorf("%s: %w: hashes to %s", objID, ErrObjectCorrupt, id)
+	}
+	return nil
+}
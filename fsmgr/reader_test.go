@@ -0,0 +1,226 @@
+package fsmgr
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+const testRepoID = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+
+var testBlkIDs = []string{
+	"2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+	"de9f2c7fd25e1b3afad3e85a0bd17d9b100db4b3",
+}
+
+func saveTestTree(t *testing.T, version int) (rootID string, fileID string) {
+	file, err := NewSeafile(version, 3*1024, testBlkIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveSeafile(testRepoID, file); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := NewSeafdir(version, []*SeafDirent{
+		NewDirent(file.FileID, "b.txt", syscall.S_IFREG|0644, 1700000000, "me@example.com", 3*1024),
+		NewDirent(EmptySha1, "a.txt", syscall.S_IFREG|0644, 1700000000, "me@example.com", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveSeafdir(testRepoID, sub); err != nil {
+		t.Fatal(err)
+	}
+	root, err := NewSeafdir(version, []*SeafDirent{
+		NewDirent(sub.DirID, "sub", syscall.S_IFDIR|0644, 1700000000, "", 0),
+		NewDirent(EmptySha1, "empty", syscall.S_IFDIR|0644, 1700000000, "", 0),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = SaveSeafdir(testRepoID, root); err != nil {
+		t.Fatal(err)
+	}
+	return root.DirID, file.FileID
+}
+
+func TestGetSeafile_RoundTrip(t *testing.T) {
+	for _, version := range []int{0, 1} {
+		Init(t.TempDir())
+		_, fileID := saveTestTree(t, version)
+		SetCacheSize(0)
+		file, err := GetSeafile(testRepoID, fileID)
+		SetCacheSize(DefaultCacheSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.Version != version || file.FileSize != 3*1024 || len(file.BlkIDs) != 2 || file.BlkIDs[1] != testBlkIDs[1] {
+			t.Fatalf("v%d: got %+v", version, file)
+		}
+		again, err := NewSeafile(file.Version, int64(file.FileSize), file.BlkIDs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if again.FileID != fileID {
+			t.Errorf("v%d: re-encoded seafile id %s, stored %s", version, again.FileID, fileID)
+		}
+		if _, err = GetSeafdir(testRepoID, fileID); err == nil {
+			t.Errorf("v%d: seafile read as seafdir", version)
+		}
+	}
+}
+
+// Version 0 objects of the tree of saveTestTree written as Seafile does, with their ids hashed as Seafile does.
+const (
+	testV0FileObject = "000000010000000000000c00" + "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12de9f2c7fd25e1b3afad3e85a0bd17d9b100db4b3"
+	testV0FileID     = "e25f17e137b2d04806d7c0a2e344500dc794a86a"
+	testV0DirObject  = "00000003" +
+		"000081a4" + "6532356631376531333762326430343830366437633061326533343435303064633739346138366100000005622e747874" +
+		"000081a4" + "3030303030303030303030303030303030303030303030303030303030303030303030303030303000000005612e747874"
+	testV0DirID = "261e1a5d2567f8de8afd198ba173dde0dc32d6b4"
+)
+
+func TestV0ObjectIDs(t *testing.T) {
+	Init(t.TempDir())
+	for id, obj := range map[string]string{testV0FileID: testV0FileObject, testV0DirID: testV0DirObject} {
+		data, _ := hex.DecodeString(obj)
+		if err := WriteRaw(testRepoID, id, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		if err := VerifyObject(testRepoID, id); err != nil {
+			t.Errorf("verify v0 object %s: %v", id, err)
+		}
+	}
+	file, err := GetSeafile(testRepoID, testV0FileID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := NewSeafile(0, int64(file.FileSize), file.BlkIDs); err != nil || again.FileID != testV0FileID {
+		t.Errorf("v0 seafile id %v, want %s, error %v", again, testV0FileID, err)
+	}
+	dir, err := GetSeafdir(testRepoID, testV0DirID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dir.Entries) != 2 || dir.Entries[0].ID != testV0FileID || dir.Entries[1].Name != "a.txt" {
+		t.Fatalf("v0 seafdir entries %+v", dir.Entries)
+	}
+	if again, err := NewSeafdir(0, dir.Entries); err != nil || again.DirID != testV0DirID {
+		t.Errorf("v0 seafdir id %v, want %s, error %v", again, testV0DirID, err)
+	}
+	// A v0 file whose block ids do not hash to its id.
+	data, _ := hex.DecodeString(testV0FileObject)
+	data[len(data)-1] ^= 1
+	const badID = "1111111111111111111111111111111111111111"
+	if err = WriteRaw(testRepoID, badID, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifyObject(testRepoID, badID); !errors.Is(err, ErrObjectCorrupt) {
+		t.Errorf("verify of a corrupt v0 object returned %v", err)
+	}
+}
+
+func TestGetSeafdir_RoundTrip(t *testing.T) {
+	for _, version := range []int{0, 1} {
+		Init(t.TempDir())
+		rootID, _ := saveTestTree(t, version)
+		var dirs int
+		err := Walk(testRepoID, rootID, func(dirPath string, dirent *SeafDirent) error {
+			if !IsDir(dirent.Mode) || dirent.ID == EmptySha1 {
+				return nil
+			}
+			dirs++
+			dir, err := GetSeafdir(testRepoID, dirent.ID)
+			if err != nil {
+				return err
+			}
+			again, err := NewSeafdir(dir.Version, dir.Entries)
+			if err != nil {
+				return err
+			}
+			if again.DirID != dirent.ID {
+				t.Errorf("v%d: re-encoded %s id %s, stored %s", version, dirPath, again.DirID, dirent.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dirs != 1 {
+			t.Errorf("v%d: walked %d dirs", version, dirs)
+		}
+	}
+}
+
+func TestWalk(t *testing.T) {
+	Init(t.TempDir())
+	rootID, _ := saveTestTree(t, 1)
+	var paths []string
+	err := Walk(testRepoID, rootID, func(dirPath string, dirent *SeafDirent) error {
+		paths = append(paths, dirPath)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/sub", "/sub/b.txt", "/sub/a.txt", "/empty"}
+	if len(paths) != len(want) {
+		t.Fatalf("walked %v, want %v", paths, want)
+	}
+	for i := range want {
+		if paths[i] != want[i] {
+			t.Fatalf("walked %v, want %v", paths, want)
+		}
+	}
+	paths = nil
+	err = Walk(testRepoID, rootID, func(dirPath string, dirent *SeafDirent) error {
+		paths = append(paths, dirPath)
+		return SkipDir
+	})
+	if err != nil || len(paths) != 2 {
+		t.Fatalf("walk with SkipDir visited %v, error %v", paths, err)
+	}
+	// SkipDir for a file skips the rest of its directory.
+	paths = nil
+	err = Walk(testRepoID, rootID, func(dirPath string, dirent *SeafDirent) error {
+		paths = append(paths, dirPath)
+		if dirPath == "/sub/b.txt" {
+			return SkipDir
+		}
+		return nil
+	})
+	if err != nil || strings.Join(paths, ",") != "/sub,/sub/b.txt,/empty" {
+		t.Fatalf("walk with SkipDir for a file visited %v, error %v", paths, err)
+	}
+	stop := errors.New("stop")
+	if err = Walk(testRepoID, rootID, func(string, *SeafDirent) error { return stop }); err != stop {
+		t.Fatalf("walk returned %v, want the error of fn", err)
+	}
+	size, files, err := GetTreeStats(testRepoID, rootID)
+	if err != nil || size != 3*1024 || files != 2 {
+		t.Fatalf("tree stats %d bytes %d files, error %v", size, files, err)
+	}
+}
+
+func TestObjectCache(t *testing.T) {
+	c := newObjectCache(2)
+	c.put(testRepoID, "1", 1)
+	c.put(testRepoID, "2", 2)
+	c.get(testRepoID, "1")
+	c.put(testRepoID, "3", 3)
+	if _, ok := c.get(testRepoID, "2"); ok {
+		t.Error("least recently used object was kept")
+	}
+	for _, id := range []string{"1", "3"} {
+		if _, ok := c.get(testRepoID, id); !ok {
+			t.Errorf("object %s was evicted", id)
+		}
+	}
+	c.resize(0)
+	if c.order.Len() != 0 || len(c.items) != 0 {
+		t.Error("resize to 0 kept objects")
+	}
+}
@@ -1,5 +1,105 @@
 package fsmgr
 
-func ScanDir() {
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+)
 
+// PutDir places the directory dirID at path under the tree rootID and returns the id of the new root.
+// The entry at path is replaced or inserted, missing parent directories are created, and every
+// ancestor dir object is saved again with mtime and modifier. The rest of the tree is kept.
+func PutDir(repoID string, rootID string, path string, dirID string, mtime int64, modifier string) (string, error) {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return dirID, nil
+	}
+	return putDir(repoID, rootID, strings.Split(path, "/"), dirID, mtime, modifier)
+}
+
+func putDir(repoID string, parentID string, names []string, dirID string, mtime int64, modifier string) (string, error) {
+	parent, err := GetSeafdir(repoID, parentID)
+	if err != nil {
+		return "", err
+	}
+	entries := make([]*SeafDirent, 0, len(parent.Entries)+1)
+	var old *SeafDirent
+	for _, entry := range parent.Entries {
+		if entry.Name == names[0] {
+			old = entry
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	childID := dirID
+	if len(names) > 1 {
+		subID := EmptySha1
+		if old != nil {
+			if !IsDir(old.Mode) {
+				return "", fmt.Errorf("%s is not a directory: %w", names[0], syscall.ENOTDIR)
+			}
+			subID = old.ID
+		}
+		if childID, err = putDir(repoID, subID, names[1:], dirID, mtime, modifier); err != nil {
+			return "", fmt.Errorf("%s/%w", names[0], err)
+		}
+	} else if old != nil && !IsDir(old.Mode) {
+		return "", fmt.Errorf("%s is not a directory: %w", names[0], syscall.ENOTDIR)
+	}
+	mode := uint32(syscall.S_IFDIR | 0644)
+	if old != nil {
+		mode = old.Mode
+	}
+	entries = append(entries, NewDirent(childID, names[0], mode, mtime, modifier, 0))
+	sort.Sort(Dirents(entries))
+	dir, err := NewSeafdir(1, entries)
+	if err != nil {
+		return "", err
+	}
+	if err = SaveSeafdir(repoID, dir); err != nil {
+		return "", err
+	}
+	return dir.DirID, nil
+}
+
+// GetTreeStats returns the total size and the number of files of the tree rootID.
+func GetTreeStats(repoID string, rootID string) (size int64, files int64, err error) {
+	err = Walk(repoID, rootID, func(_ string, dirent *SeafDirent) error {
+		if IsRegular(dirent.Mode) {
+			size += dirent.Size
+			files++
+		}
+		return nil
+	})
+	return
+}
+
+// GetDirent returns the entry at path in the tree rootID. The root is returned as a directory entry without a name.
+func GetDirent(repoID string, rootID string, path string) (*SeafDirent, error) {
+	dirent := &SeafDirent{ID: rootID, Mode: syscall.S_IFDIR | 0644}
+	for _, name := range strings.Split(strings.Trim(path, "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if !IsDir(dirent.Mode) {
+			return nil, fmt.Errorf("%s is not a directory: %w", dirent.Name, syscall.ENOTDIR)
+		}
+		dir, err := GetSeafdir(repoID, dirent.ID)
+		if err != nil {
+			return nil, err
+		}
+		var found *SeafDirent
+		for _, entry := range dir.Entries {
+			if entry.Name == name {
+				found = entry
+				break
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("%s: %w", name, syscall.ENOENT)
+		}
+		dirent = found
+	}
+	return dirent, nil
 }
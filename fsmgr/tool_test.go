@@ -0,0 +1,63 @@
+package fsmgr
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestPutDir(t *testing.T) {
+	Init(t.TempDir())
+	rootID, _ := saveTestTree(t, 1)
+	scan, err := NewSeafdir(1, []*SeafDirent{NewDirent(EmptySha1, "c.txt", syscall.S_IFREG|0644, 1700000000, "me@example.com", 0)})
+	if err == nil {
+		err = SaveSeafdir(testRepoID, scan)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// tree lists the entries under rootID with the mtime of the directories.
+	tree := func(rootID string) string {
+		var paths []string
+		err := Walk(testRepoID, rootID, func(dirPath string, dirent *SeafDirent) error {
+			if IsDir(dirent.Mode) {
+				dirPath += fmt.Sprintf("@%d", dirent.Mtime)
+			}
+			paths = append(paths, dirPath)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(paths)
+		return strings.Join(paths, ",")
+	}
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/", "/c.txt"},
+		// Missing ancestors are created.
+		{"/new/deep", "/empty@1700000000,/new/deep/c.txt,/new/deep@1800000000,/new@1800000000," +
+			"/sub/a.txt,/sub/b.txt,/sub@1700000000"},
+		// An existing ancestor keeps its entries.
+		{"/sub/inner", "/empty@1700000000,/sub/a.txt,/sub/b.txt,/sub/inner/c.txt,/sub/inner@1800000000," +
+			"/sub@1800000000"},
+		// The directory at path is replaced.
+		{"sub", "/empty@1700000000,/sub/c.txt,/sub@1800000000"},
+	} {
+		newID, err := PutDir(testRepoID, rootID, tt.path, scan.DirID, 1800000000, "me@qq.com")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.path, err)
+		}
+		if got := tree(newID); got != tt.want {
+			t.Errorf("%s: tree %s, want %s", tt.path, got, tt.want)
+		}
+	}
+	if _, err = PutDir(testRepoID, rootID, "/sub/b.txt/inner", scan.DirID, 1800000000, "me@qq.com"); !errors.Is(err, syscall.ENOTDIR) {
+		t.Errorf("graft under a file returned %v", err)
+	}
+}
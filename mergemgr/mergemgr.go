@@ -0,0 +1,175 @@
+// Package mergemgr merges fs trees of a library.
+package mergemgr
+
+import (
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy decides which side wins when the library and the scan changed the same entry.
+type Policy string
+
+const (
+	// PreferScan keeps the entry of the scan.
+	PreferScan Policy = "scan"
+	// PreferLibrary keeps the entry of the library.
+	PreferLibrary Policy = "library"
+	// KeepBoth keeps the entry of the library and adds the entry of the scan under a conflict name.
+	// A directory keeps the name when it conflicts with a file.
+	KeepBoth Policy = "both"
+)
+
+// ParsePolicy parses the name of a policy.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PreferScan, PreferLibrary, KeepBoth:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown conflict policy %q, must be one of scan, library or both", name)
+}
+
+// Merger merges the trees of a scan into the library.
+type Merger struct {
+	RepoID string
+	Policy Policy
+	// User is put in the conflict names.
+	User string
+	// Time is put in the conflict names.
+	Time time.Time
+	// Conflicts are the paths of the entries both sides changed, in the order they were merged.
+	Conflicts []string
+}
+
+// Merge merges the changes from base to library and from base to scan, and returns the id of the merged tree.
+func (m *Merger) Merge(base, library, scan string) (string, error) {
+	return m.mergeDir("/", base, library, scan)
+}
+
+func sameEntry(a, b *fsmgr.SeafDirent) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.ID == b.ID && a.Mode == b.Mode
+}
+
+func entryMap(dir *fsmgr.SeafDir) map[string]*fsmgr.SeafDirent {
+	entries := make(map[string]*fsmgr.SeafDirent, len(dir.Entries))
+	for _, entry := range dir.Entries {
+		entries[entry.Name] = entry
+	}
+	return entries
+}
+
+func (m *Merger) mergeDir(dirPath string, base, library, scan string) (string, error) {
+	switch {
+	case library == scan, base == scan:
+		return library, nil
+	case base == library:
+		return scan, nil
+	}
+	var dirs [3]map[string]*fsmgr.SeafDirent
+	names := make(map[string]bool)
+	for i, id := range []string{base, library, scan} {
+		dir, err := fsmgr.GetSeafdir(m.RepoID, id)
+		if err != nil {
+			return "", err
+		}
+		dirs[i] = entryMap(dir)
+		for name := range dirs[i] {
+			names[name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	var entries []*fsmgr.SeafDirent
+	var conflicts [][2]*fsmgr.SeafDirent
+	for _, name := range sorted {
+		b, l, s := dirs[0][name], dirs[1][name], dirs[2][name]
+		switch {
+		case sameEntry(l, s), sameEntry(b, s):
+			if l != nil {
+				entries = append(entries, l)
+			}
+		case sameEntry(b, l):
+			if s != nil {
+				entries = append(entries, s)
+			}
+		case l == nil:
+			// Changed on one side and deleted on the other, the change is kept.
+			entries = append(entries, s)
+		case s == nil:
+			entries = append(entries, l)
+		case fsmgr.IsDir(l.Mode) && fsmgr.IsDir(s.Mode):
+			baseId := fsmgr.EmptySha1
+			if b != nil && fsmgr.IsDir(b.Mode) {
+				baseId = b.ID
+			}
+			id, err := m.mergeDir(path.Join(dirPath, name), baseId, l.ID, s.ID)
+			if err != nil {
+				return "", err
+			}
+			merged := *l
+			merged.ID = id
+			merged.Mtime = max(l.Mtime, s.Mtime)
+			entries = append(entries, &merged)
+		default:
+			conflicts = append(conflicts, [2]*fsmgr.SeafDirent{l, s})
+		}
+	}
+	taken := make(map[string]bool, len(entries)+len(conflicts))
+	for _, entry := range entries {
+		taken[entry.Name] = true
+	}
+	for _, c := range conflicts {
+		l, s := c[0], c[1]
+		m.Conflicts = append(m.Conflicts, path.Join(dirPath, l.Name))
+		switch m.Policy {
+		case PreferScan:
+			entries = append(entries, s)
+			continue
+		case PreferLibrary:
+			entries = append(entries, l)
+			continue
+		}
+		keep, rename := l, s
+		if fsmgr.IsDir(s.Mode) && !fsmgr.IsDir(l.Mode) {
+			keep, rename = s, l
+		}
+		renamed := *rename
+		renamed.Name = m.conflictName(rename.Name, taken)
+		taken[renamed.Name] = true
+		entries = append(entries, keep, &renamed)
+	}
+	sort.Sort(fsmgr.Dirents(entries))
+	dir, err := fsmgr.NewSeafdir(1, entries)
+	if err != nil {
+		return "", err
+	}
+	if err = fsmgr.SaveSeafdir(m.RepoID, dir); err != nil {
+		return "", err
+	}
+	return dir.DirID, nil
+}
+
+// conflictName returns the name Seafile gives to the conflicting copy of name, e.g.
+// "report (SFConflict user@example.com 2024-01-02-15-04-05).pdf", that is not in taken.
+func (m *Merger) conflictName(name string, taken map[string]bool) string {
+	ext := path.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+	stem := strings.TrimSuffix(name, ext)
+	suffix := fmt.Sprintf(" (SFConflict %s %s)", m.User, m.Time.Format("2006-01-02-15-04-05"))
+	conflict := stem + suffix + ext
+	for i := 1; taken[conflict]; i++ {
+		conflict = fmt.Sprintf("%s%s-%d%s", stem, suffix, i, ext)
+	}
+	return conflict
+}
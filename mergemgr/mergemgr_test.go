@@ -0,0 +1,130 @@
+package mergemgr
+
+import (
+	"github.com/manx98/local_to_seaf_store/fsmgr"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testRepoID = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+
+// makeTree saves a tree of files given as path to file id and returns its root id.
+func makeTree(t *testing.T, files map[string]string) string {
+	children := make(map[string]map[string]string)
+	for p, id := range files {
+		dir, name := path.Split(p)
+		dir = strings.TrimSuffix(dir, "/")
+		if children[dir] == nil {
+			children[dir] = make(map[string]string)
+		}
+		children[dir][name] = id
+		for dir != "" {
+			parent, name := path.Split(dir)
+			parent = strings.TrimSuffix(parent, "/")
+			if children[parent] == nil {
+				children[parent] = make(map[string]string)
+			}
+			children[parent][name+"/"] = ""
+			dir = parent
+		}
+	}
+	var save func(dir string) string
+	save = func(dir string) string {
+		var entries []*fsmgr.SeafDirent
+		for name, id := range children[dir] {
+			if strings.HasSuffix(name, "/") {
+				name = strings.TrimSuffix(name, "/")
+				entries = append(entries, fsmgr.NewDirent(save(path.Join(dir, name)), name, syscall.S_IFDIR|0644, 1, "", 0))
+			} else {
+				entries = append(entries, fsmgr.NewDirent(id, name, syscall.S_IFREG|0644, 1, "me", 1))
+			}
+		}
+		sort.Sort(fsmgr.Dirents(entries))
+		seafdir, err := fsmgr.NewSeafdir(1, entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = fsmgr.SaveSeafdir(testRepoID, seafdir); err != nil {
+			t.Fatal(err)
+		}
+		return seafdir.DirID
+	}
+	return save("")
+}
+
+// listTree returns the files of the tree rootID as path to file id.
+func listTree(t *testing.T, rootID string) map[string]string {
+	files := make(map[string]string)
+	var walk func(dir string, id string)
+	walk = func(dir string, id string) {
+		seafdir, err := fsmgr.GetSeafdir(testRepoID, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range seafdir.Entries {
+			if fsmgr.IsDir(entry.Mode) {
+				walk(path.Join(dir, entry.Name), entry.ID)
+			} else {
+				files[path.Join(dir, entry.Name)] = entry.ID
+			}
+		}
+	}
+	walk("", rootID)
+	return files
+}
+
+const (
+	idA = "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	idB = "bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb"
+	idC = "cccccccccccccccccccccccccccccccccccccccc"
+)
+
+func TestMerger_Merge(t *testing.T) {
+	fsmgr.Init(t.TempDir())
+	base := makeTree(t, map[string]string{"keep": idA, "docs/edit": idA, "docs/gone": idA, "both": idA})
+	library := makeTree(t, map[string]string{"keep": idA, "docs/edit": idB, "upload": idA, "both": idB})
+	scan := makeTree(t, map[string]string{"keep": idA, "docs/edit": idA, "docs/gone": idA, "docs/new": idC, "both": idC})
+	when := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	for _, c := range []struct {
+		policy Policy
+		want   map[string]string
+	}{
+		{PreferScan, map[string]string{"keep": idA, "docs/edit": idB, "docs/new": idC, "upload": idA, "both": idC}},
+		{PreferLibrary, map[string]string{"keep": idA, "docs/edit": idB, "docs/new": idC, "upload": idA, "both": idB}},
+		{KeepBoth, map[string]string{"keep": idA, "docs/edit": idB, "docs/new": idC, "upload": idA, "both": idB,
+			"both (SFConflict me@example.com 2024-01-02-15-04-05)": idC}},
+	} {
+		m := &Merger{RepoID: testRepoID, Policy: c.policy, User: "me@example.com", Time: when}
+		root, err := m.Merge(base, library, scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := listTree(t, root)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.policy, got, c.want)
+		}
+		for p, id := range c.want {
+			if got[p] != id {
+				t.Errorf("%s: %s is %q, want %q", c.policy, p, got[p], id)
+			}
+		}
+		if len(m.Conflicts) != 1 || m.Conflicts[0] != "/both" {
+			t.Errorf("%s: conflicts %v", c.policy, m.Conflicts)
+		}
+	}
+}
+
+func TestMerger_conflictName(t *testing.T) {
+	m := &Merger{User: "me@example.com", Time: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)}
+	taken := map[string]bool{"report (SFConflict me@example.com 2024-01-02-15-04-05).pdf": true}
+	if got := m.conflictName("report.pdf", taken); got != "report (SFConflict me@example.com 2024-01-02-15-04-05)-1.pdf" {
+		t.Errorf("got %s", got)
+	}
+	if got := m.conflictName(".bashrc", nil); got != ".bashrc (SFConflict me@example.com 2024-01-02-15-04-05)" {
+		t.Errorf("got %s", got)
+	}
+}
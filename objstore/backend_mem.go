@@ -0,0 +1,64 @@
+// Implementation of in-memory storage backend.
+package objstore
+
+import (
+	"bytes"
+	"io"
+	"path"
+	"sync"
+)
+
+// memBackend keeps written objects in memory and reads the other objects from a file system backend,
+// which is never written to.
+type memBackend struct {
+	base *fsBackend
+	mu   sync.RWMutex
+	objs map[string][]byte
+}
+
+func newMemBackend(dataDir string, objType string) *memBackend {
+	return &memBackend{
+		base: &fsBackend{objDir: path.Join(dataDir, "storage", objType), objType: objType},
+		objs: make(map[string][]byte),
+	}
+}
+
+func (b *memBackend) get(repoID string, objID string) ([]byte, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	data, ok := b.objs[repoID+"/"+objID]
+	return data, ok
+}
+
+func (b *memBackend) read(repoID string, objID string, w io.Writer) error {
+	if data, ok := b.get(repoID, objID); ok {
+		_, err := w.Write(data)
+		return err
+	}
+	return b.base.read(repoID, objID, w)
+}
+
+func (b *memBackend) write(repoID string, objID string, r io.Reader, sync bool) error {
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.objs[repoID+"/"+objID] = buf.Bytes()
+	return nil
+}
+
+func (b *memBackend) exists(repoID string, objID string) (bool, error) {
+	if _, ok := b.get(repoID, objID); ok {
+		return true, nil
+	}
+	return b.base.exists(repoID, objID)
+}
+
+func (b *memBackend) stat(repoID string, objID string) (int64, error) {
+	if data, ok := b.get(repoID, objID); ok {
+		return int64(len(data)), nil
+	}
+	return b.base.stat(repoID, objID)
+}
@@ -40,6 +40,15 @@ func New(dataDir string, objType string) *ObjectStore {
 	return obj
 }
 
+// NewScratch returns an object store that reads objects from dataDir but keeps the objects written to it in memory.
+// Nothing is ever written to dataDir.
+func NewScratch(dataDir string, objType string) *ObjectStore {
+	obj := new(ObjectStore)
+	obj.ObjType = objType
+	obj.backend = newMemBackend(dataDir, objType)
+	return obj
+}
+
 // Read data from storage backends.
 func (s *ObjectStore) Read(repoID string, objID string, w io.Writer) (err error) {
 	return s.backend.read(repoID, objID, w)
@@ -0,0 +1,72 @@
+package seafdb
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ReadConfig reads the [database] section of seafile.conf and returns the driver and the dsn to Open it.
+// Without a database section Seafile uses seafile.db in its data dir seafileDataDir.
+func ReadConfig(file string, seafileDataDir string) (driver string, dsn string, err error) {
+	section, err := readIniSection(file, "database")
+	if err != nil {
+		return "", "", err
+	}
+	switch strings.ToLower(section["type"]) {
+	case "", "sqlite":
+		return DriverSQLite, filepath.Join(seafileDataDir, "seafile.db"), nil
+	case "mysql":
+	default:
+		return "", "", fmt.Errorf("%s: unsupported database type %q", file, section["type"])
+	}
+	cfg := mysql.NewConfig()
+	cfg.User = section["user"]
+	cfg.Passwd = section["password"]
+	cfg.DBName = section["db_name"]
+	if socket := section["unix_socket"]; socket != "" {
+		cfg.Net, cfg.Addr = "unix", socket
+	} else {
+		host, port := section["host"], section["port"]
+		if host == "" {
+			host = "127.0.0.1"
+		}
+		if port == "" {
+			port = "3306"
+		}
+		cfg.Net, cfg.Addr = "tcp", host+":"+port
+	}
+	if charset := section["connection_charset"]; charset != "" {
+		cfg.Params = map[string]string{"charset": charset}
+	}
+	return DriverMySQL, cfg.FormatDSN(), nil
+}
+
+// readIniSection returns the keys of a section of an ini file, in the format read by GKeyFile.
+func readIniSection(file string, name string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	values := make(map[string]string)
+	var inSection bool
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == name
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && inSection {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values, scanner.Err()
+}
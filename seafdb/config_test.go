@@ -0,0 +1,34 @@
+package seafdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	dir := t.TempDir()
+	for _, c := range []struct {
+		conf   string
+		driver string
+		dsn    string
+	}{
+		{"[fileserver]\nport = 8082\n", DriverSQLite, "/seafile-data/seafile.db"},
+		{"[database]\ntype = mysql\nhost = db\nuser = seafile\npassword = p@ss\ndb_name = seafile_db\nconnection_charset = utf8\n",
+			DriverMySQL, "seafile:p@ss@tcp(db:3306)/seafile_db?charset=utf8"},
+		{"[database]\ntype = mysql\nunix_socket = /run/mysqld/mysqld.sock\nuser = seafile\ndb_name = seafile_db\n",
+			DriverMySQL, "seafile@unix(/run/mysqld/mysqld.sock)/seafile_db"},
+	} {
+		file := filepath.Join(dir, "seafile.conf")
+		if err := os.WriteFile(file, []byte(c.conf), 0644); err != nil {
+			t.Fatal(err)
+		}
+		driver, dsn, err := ReadConfig(file, "/seafile-data")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if driver != c.driver || dsn != c.dsn {
+			t.Errorf("got %s %s, want %s %s", driver, dsn, c.driver, c.dsn)
+		}
+	}
+}
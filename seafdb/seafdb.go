@@ -0,0 +1,177 @@
+// Package seafdb updates the Seafile database, the SQLite seafile.db or a MySQL database.
+package seafdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	_ "github.com/go-sql-driver/mysql"
+	_ "modernc.org/sqlite"
+	"net/url"
+)
+
+// Supported drivers. The SQLite driver is pure Go, the binary builds without cgo.
+const (
+	DriverSQLite = "sqlite"
+	DriverMySQL  = "mysql"
+)
+
+// MasterBranch is the branch Seafile shows as the head of a library.
+const MasterBranch = "master"
+
+// ErrHeadMoved is returned when the branch does not point to the expected commit.
+var ErrHeadMoved = errors.New("branch head has moved")
+
+// ErrNoBranch is returned when the library has no such branch.
+var ErrNoBranch = errors.New("branch not found")
+
+// DB is a Seafile database.
+type DB struct {
+	db     *sql.DB
+	driver string
+}
+
+// Open opens the Seafile database, dsn is the path of seafile.db for DriverSQLite.
+func Open(driver string, dsn string) (*DB, error) {
+	switch driver {
+	case DriverSQLite:
+		// Seafile keeps the database open, wait for its locks instead of failing. The path is escaped,
+		// a ? or # in it is not read as the start of the parameters.
+		dsn = (&url.URL{Scheme: "file", Path: dsn, RawQuery: "_pragma=busy_timeout(10000)&_txlock=immediate"}).String()
+	case DriverMySQL:
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", driver)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err = db.Ping(); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("connect %s database: %w", driver, err)
+	}
+	return &DB{db: db, driver: driver}, nil
+}
+
+func (d *DB) Close() error {
+	return d.db.Close()
+}
+
+// GetBranch returns the commit id the branch of repoID points to.
+func (d *DB) GetBranch(ctx context.Context, repoID string, name string) (string, error) {
+	return getBranch(ctx, d.db, repoID, name)
+}
+
+type querier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func getBranch(ctx context.Context, q querier, repoID string, name string) (commitID string, err error) {
+	err = q.QueryRowContext(ctx, "SELECT commit_id FROM Branch WHERE repo_id=? AND name=?", repoID, name).Scan(&commitID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", fmt.Errorf("%s of %s: %w", name, repoID, ErrNoBranch)
+	}
+	return
+}
+
+// HeadUpdate is the new state of a library after a commit.
+type HeadUpdate struct {
+	RepoID    string
+	OldHead   string
+	NewHead   string
+	Size      int64
+	FileCount int64
+}
+
+// UpdateHead moves the master branch of the library from OldHead to NewHead and records the size and
+// the file count of NewHead, all in one transaction. It fails with ErrHeadMoved if the branch is not at OldHead.
+func (d *DB) UpdateHead(ctx context.Context, u *HeadUpdate) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.ExecContext(ctx, "UPDATE Branch SET commit_id=? WHERE repo_id=? AND name=? AND commit_id=?",
+		u.NewHead, u.RepoID, MasterBranch, u.OldHead)
+	if err != nil {
+		return fmt.Errorf("update branch: %w", err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n != 1 {
+		head, err := getBranch(ctx, tx, u.RepoID, MasterBranch)
+		if err != nil {
+			return err
+		}
+		if head != u.NewHead {
+			return fmt.Errorf("%s of %s is at %s, not %s: %w", MasterBranch, u.RepoID, head, u.OldHead, ErrHeadMoved)
+		}
+	}
+	if _, err = tx.ExecContext(ctx, "REPLACE INTO RepoSize (repo_id, size, head_id) VALUES (?, ?, ?)",
+		u.RepoID, u.Size, u.NewHead); err != nil {
+		return fmt.Errorf("update repo size: %w", err)
+	}
+	if _, err = tx.ExecContext(ctx, "REPLACE INTO RepoFileCount (repo_id, file_count) VALUES (?, ?)",
+		u.RepoID, u.FileCount); err != nil {
+		return fmt.Errorf("update repo file count: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ErrRepoExists is returned when a library with the repo id is already registered.
+var ErrRepoExists = errors.New("library already exists")
+
+// NewRepo describes a library to register.
+type NewRepo struct {
+	RepoID    string
+	Name      string
+	Owner     string
+	Version   int
+	Head      string
+	Size      int64
+	FileCount int64
+	// UpdateTime is the unix time of the head commit.
+	UpdateTime int64
+}
+
+// RepoExists reports whether the library repoID is registered.
+func (d *DB) RepoExists(ctx context.Context, repoID string) (bool, error) {
+	var n int
+	err := d.db.QueryRowContext(ctx, "SELECT COUNT(1) FROM Repo WHERE repo_id=?", repoID).Scan(&n)
+	return n > 0, err
+}
+
+// CreateRepo registers the library r with its master branch at r.Head, all in one transaction.
+func (d *DB) CreateRepo(ctx context.Context, r *NewRepo) error {
+	tx, err := d.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var n int
+	if err = tx.QueryRowContext(ctx, "SELECT COUNT(1) FROM Repo WHERE repo_id=?", r.RepoID).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("%s: %w", r.RepoID, ErrRepoExists)
+	}
+	for _, stmt := range []struct {
+		query string
+		args  []any
+	}{
+		{"INSERT INTO Repo (repo_id) VALUES (?)", []any{r.RepoID}},
+		{"INSERT INTO Branch (name, repo_id, commit_id) VALUES (?, ?, ?)", []any{MasterBranch, r.RepoID, r.Head}},
+		{"INSERT INTO RepoHead (repo_id, branch_name) VALUES (?, ?)", []any{r.RepoID, MasterBranch}},
+		{"INSERT INTO RepoOwner (repo_id, owner_id) VALUES (?, ?)", []any{r.RepoID, r.Owner}},
+		{"INSERT INTO RepoInfo (repo_id, name, update_time, version, is_encrypted, last_modifier) VALUES (?, ?, ?, ?, 0, ?)",
+			[]any{r.RepoID, r.Name, r.UpdateTime, r.Version, r.Owner}},
+		{"REPLACE INTO RepoSize (repo_id, size, head_id) VALUES (?, ?, ?)", []any{r.RepoID, r.Size, r.Head}},
+		{"REPLACE INTO RepoFileCount (repo_id, file_count) VALUES (?, ?)", []any{r.RepoID, r.FileCount}},
+	} {
+		if _, err = tx.ExecContext(ctx, stmt.query, stmt.args...); err != nil {
+			return fmt.Errorf("register library: %w", err)
+		}
+	}
+	return tx.Commit()
+}
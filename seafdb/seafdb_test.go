@@ -0,0 +1,157 @@
+package seafdb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const (
+	testRepoID = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	testHead   = "363b24f55f52da85cf9eb7fa0f9c8bf30325da75"
+	testCommit = "7c4be441b8f7f9c999f29837716ea79e44437995"
+)
+
+// schema is the part of the seafile.db schema created by seaf-server for SQLite.
+var schema = []string{
+	"CREATE TABLE Repo (repo_id CHAR(37) PRIMARY KEY)",
+	"CREATE TABLE RepoOwner (repo_id CHAR(37) PRIMARY KEY, owner_id TEXT)",
+	"CREATE TABLE RepoInfo (repo_id CHAR(36) PRIMARY KEY, name VARCHAR(255) NOT NULL, update_time INTEGER, version INTEGER, " +
+		"is_encrypted INTEGER, last_modifier VARCHAR(255), status INTEGER DEFAULT 0, type VARCHAR(10))",
+	"CREATE TABLE Branch (name VARCHAR(10), repo_id CHAR(41), commit_id CHAR(41), PRIMARY KEY (repo_id, name))",
+	"CREATE TABLE RepoHead (repo_id CHAR(37) PRIMARY KEY, branch_name VARCHAR(10))",
+	"CREATE TABLE RepoSize (repo_id CHAR(37) PRIMARY KEY, size BIGINT UNSIGNED, head_id CHAR(41))",
+	"CREATE TABLE RepoFileCount (repo_id CHAR(36) PRIMARY KEY, file_count BIGINT UNSIGNED)",
+}
+
+func openTestDB(t *testing.T) *DB {
+	return openTestDBAt(t, "")
+}
+
+// openTestDBAt creates the test database and opens it after moving it to dir, a directory in a temp dir.
+func openTestDBAt(t *testing.T, dir string) *DB {
+	tmp := t.TempDir()
+	file := filepath.Join(tmp, "seafile.db")
+	raw, err := sql.Open(DriverSQLite, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	stmts := append(schema,
+		"INSERT INTO Repo VALUES ('"+testRepoID+"')",
+		"INSERT INTO Branch VALUES ('master', '"+testRepoID+"', '"+testHead+"')",
+		"INSERT INTO RepoHead VALUES ('"+testRepoID+"', 'master')",
+		"INSERT INTO RepoSize VALUES ('"+testRepoID+"', 10, '"+testHead+"')",
+	)
+	for _, stmt := range stmts {
+		if _, err = raw.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if dir != "" {
+		moved := filepath.Join(tmp, dir, "seafile.db")
+		if err = os.Mkdir(filepath.Dir(moved), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err = os.Rename(file, moved); err != nil {
+			t.Fatal(err)
+		}
+		file = moved
+	}
+	db, err := Open(DriverSQLite, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestOpen_EscapedPath(t *testing.T) {
+	// Neither the ? and # of the path nor the parameters after them are read from the dsn.
+	db := openTestDBAt(t, "a?mode=ro#b%20c")
+	ctx := context.Background()
+	u := &HeadUpdate{RepoID: testRepoID, OldHead: testHead, NewHead: testCommit, Size: 4096, FileCount: 3}
+	if err := db.UpdateHead(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	if head, err := db.GetBranch(ctx, testRepoID, MasterBranch); err != nil || head != testCommit {
+		t.Fatalf("head is %s, %v, want %s", head, err, testCommit)
+	}
+}
+
+func TestDB_UpdateHead(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	u := &HeadUpdate{RepoID: testRepoID, OldHead: testHead, NewHead: testCommit, Size: 4096, FileCount: 3}
+	if err := db.UpdateHead(ctx, u); err != nil {
+		t.Fatal(err)
+	}
+	head, err := db.GetBranch(ctx, testRepoID, MasterBranch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != testCommit {
+		t.Fatalf("head is %s, want %s", head, testCommit)
+	}
+	var size, count int64
+	var headID string
+	if err = db.db.QueryRow("SELECT size, head_id FROM RepoSize WHERE repo_id=?", testRepoID).Scan(&size, &headID); err != nil {
+		t.Fatal(err)
+	}
+	if err = db.db.QueryRow("SELECT file_count FROM RepoFileCount WHERE repo_id=?", testRepoID).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if size != 4096 || headID != testCommit || count != 3 {
+		t.Fatalf("got size %d head %s file count %d", size, headID, count)
+	}
+}
+
+func TestDB_UpdateHeadMoved(t *testing.T) {
+	db := openTestDB(t)
+	u := &HeadUpdate{RepoID: testRepoID, OldHead: testCommit, NewHead: "0e1e6dfae5f3424156951f5927a9586049bac66c"}
+	if err := db.UpdateHead(context.Background(), u); !errors.Is(err, ErrHeadMoved) {
+		t.Fatalf("got error %v, want ErrHeadMoved", err)
+	}
+	head, err := db.GetBranch(context.Background(), testRepoID, MasterBranch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != testHead {
+		t.Fatalf("head moved to %s", head)
+	}
+	u.RepoID = "00a57a07-79b0-4156-ab36-a556cfa54d57"
+	if err = db.UpdateHead(context.Background(), u); !errors.Is(err, ErrNoBranch) {
+		t.Fatalf("got error %v, want ErrNoBranch", err)
+	}
+}
+
+func TestDB_CreateRepo(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	r := &NewRepo{RepoID: "00a57a07-79b0-4156-ab36-a556cfa54d57", Name: "Mirror", Owner: "user@example.com",
+		Version: 1, Head: testCommit, Size: 100, FileCount: 2, UpdateTime: 1700000000}
+	if err := db.CreateRepo(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	head, err := db.GetBranch(ctx, r.RepoID, MasterBranch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head != testCommit {
+		t.Fatalf("head is %s, want %s", head, testCommit)
+	}
+	var name, owner string
+	if err = db.db.QueryRow("SELECT i.name, o.owner_id FROM RepoInfo i JOIN RepoOwner o ON i.repo_id=o.repo_id WHERE i.repo_id=?",
+		r.RepoID).Scan(&name, &owner); err != nil {
+		t.Fatal(err)
+	}
+	if name != r.Name || owner != r.Owner {
+		t.Fatalf("got name %s owner %s", name, owner)
+	}
+	if err = db.CreateRepo(ctx, r); !errors.Is(err, ErrRepoExists) {
+		t.Fatalf("got error %v, want ErrRepoExists", err)
+	}
+}
@@ -3,7 +3,12 @@ package utils
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"fmt"
 	"github.com/google/uuid"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
 )
 
 func RandId() string {
@@ -30,3 +35,36 @@ func IsObjectIDValid(objID string) bool {
 	}
 	return true
 }
+
+// CheckFileName checks whether Seafile accepts name as the name of a file or directory.
+func CheckFileName(name string) error {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return fmt.Errorf("reserved name %q", name)
+	case !utf8.ValidString(name):
+		return fmt.Errorf("name %q is not valid UTF-8", name)
+	case len(name) >= 256:
+		return fmt.Errorf("name is %d bytes long, limit is 255", len(name))
+	case strings.ContainsAny(name, "/\x00"):
+		return fmt.Errorf("name %q contains '/' or NUL", name)
+	}
+	return nil
+}
+
+// ParseSize parses a size such as "512", "10K", "1.5G" or "2TiB", units are powers of 1024.
+func ParseSize(s string) (int64, error) {
+	text := strings.ToUpper(strings.TrimSpace(s))
+	text = strings.TrimSuffix(strings.TrimSuffix(text, "B"), "I")
+	unit := float64(1)
+	if text != "" {
+		if i := strings.IndexByte("KMGTP", text[len(text)-1]); i >= 0 {
+			unit = math.Pow(1024, float64(i+1))
+			text = text[:len(text)-1]
+		}
+	}
+	value, err := strconv.ParseFloat(text, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(value * unit), nil
+}
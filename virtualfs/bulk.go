@@ -0,0 +1,191 @@
+package virtualfs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// bulkFillPercent packs the pages of the buckets whose keys only grow, the real file ids. The other buckets
+// get keys between those of earlier flushes and keep the default, full pages would split on the next flush.
+const bulkFillPercent = 0.9
+
+// BulkLoader is a Mapper for large imports. It buffers the writes of many files in memory
+// and writes them sorted by key in one transaction when the buffer reaches its limit.
+type BulkLoader struct {
+	mu     sync.Mutex
+	limit  int
+	count  int
+	nextId uint64
+	// pending maps bucket name to key to value, a nil value deletes the key.
+	pending map[string]map[string][]byte
+}
+
+// NewBulkLoader creates a BulkLoader that flushes after buffering limit entries.
+func NewBulkLoader(limit int) *BulkLoader {
+	return &BulkLoader{
+		limit:   max(limit, 1),
+		nextId:  globalId,
+		pending: make(map[string]map[string][]byte),
+	}
+}
+
+func (b *BulkLoader) get(tx *bbolt.Tx, bucket string, key string) []byte {
+	return (&MappingView{tx: tx, pending: b.pending}).get(bucket, key)
+}
+
+func (b *BulkLoader) put(bucket string, key string, value []byte) {
+	values, ok := b.pending[bucket]
+	if !ok {
+		values = make(map[string][]byte)
+		b.pending[bucket] = values
+	}
+	values[key] = value
+	b.count++
+}
+
+func (b *BulkLoader) PutFile(repoId string, path string, info *RealFileInfo, blockSize int64, kind byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	err := view(func(tx *bbolt.Tx) error {
+		if kind != ProxyContent {
+			for _, blkId := range info.BlkIDs {
+				blkPath := ProxyPath(repoId, blkId)
+				if b.get(tx, filepath.Dir(blkPath), filepath.Base(blkPath)) != nil {
+					return syscall.EEXIST
+				}
+			}
+		}
+		var id uint64
+		if idData := b.get(tx, RealPathToIdBucketName, path); idData != nil {
+			id = binary.BigEndian.Uint64(idData)
+		} else {
+			b.nextId++
+			id = b.nextId
+			idData = binary.BigEndian.AppendUint64([]byte{}, id)
+			b.put(RealPathToIdBucketName, path, idData)
+			b.put(IdToRealPathBucketName, string(idData), []byte(path))
+		}
+		old, err := decodeRealFileInfo([]byte(path), b.get(tx, RealFileInfoBucketName, path))
+		if err != nil {
+			return err
+		}
+		if old != nil && !old.Unchanged(info) {
+			for _, blkId := range old.BlkIDs {
+				blkPath := ProxyPath(repoId, blkId)
+				if staleWith(b.get(tx, filepath.Dir(blkPath), filepath.Base(blkPath)), id) {
+					b.put(StaleBucketName, blkPath, staleTime())
+				}
+			}
+		}
+		for i, blkId := range info.BlkIDs {
+			blkPath := ProxyPath(repoId, blkId)
+			parent, name := filepath.Dir(blkPath), filepath.Base(blkPath)
+			if i < len(info.Sums) {
+				b.put(ChecksumBucketName, blkPath, info.Sums[i])
+			}
+			if kind == ProxyContent {
+				existing := b.get(tx, parent, name)
+				if pointsTo(existing, id) && b.get(tx, StaleBucketName, blkPath) == nil &&
+					b.get(tx, TombstoneBucketName, blkPath) == nil && b.get(tx, TombstoneBucketName, parent) == nil {
+					continue
+				}
+				b.put(StaleBucketName, blkPath, nil)
+			}
+			offset := int64(i) * blockSize
+			b.put(parent, name, encodeProxyFile(id, offset, min(blockSize, info.Size-offset), info.Mtime, kind))
+			b.put(TombstoneBucketName, blkPath, nil)
+			b.put(TombstoneBucketName, parent, nil)
+		}
+		data, err := encodeRealFileInfo(info)
+		if err != nil {
+			return err
+		}
+		b.put(RealFileInfoBucketName, path, data)
+		return nil
+	})
+	if err != nil || b.count < b.limit {
+		return err
+	}
+	return b.flush()
+}
+
+func (b *BulkLoader) Checkpoint(path string, dirId string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.put(JournalBucketName, path, []byte(dirId))
+	return nil
+}
+
+// View calls fn with a view of the mapping that includes the buffered entries.
+func (b *BulkLoader) View(fn func(v *MappingView) error) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return view(func(tx *bbolt.Tx) error {
+		return fn(&MappingView{tx: tx, pending: b.pending})
+	})
+}
+
+// Flush writes all buffered entries.
+func (b *BulkLoader) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush()
+}
+
+func (b *BulkLoader) flush() error {
+	if b.count == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(b.pending))
+	for name := range b.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	err := update(func(tx *bbolt.Tx) error {
+		for _, name := range names {
+			bucket := tx.Bucket([]byte(name))
+			if bucket == nil {
+				if !strings.HasPrefix(name, "/") {
+					return fmt.Errorf("%s bucket not exist: %w", name, syscall.EIO)
+				}
+				if err := MkdirAll(tx, name); err != nil {
+					return fmt.Errorf("mkdir %s: %w", name, err)
+				}
+				bucket = tx.Bucket([]byte(name))
+			}
+			if name == IdToRealPathBucketName {
+				bucket.FillPercent = bulkFillPercent
+			}
+			values := b.pending[name]
+			keys := make([]string, 0, len(values))
+			for key := range values {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				var err error
+				if value := values[key]; value == nil {
+					err = bucket.Delete([]byte(key))
+				} else {
+					err = bucket.Put([]byte(key), value)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return UpdateNextId(tx, b.nextId)
+	})
+	if err != nil {
+		return fmt.Errorf("flush bulk load: %w", err)
+	}
+	b.pending = make(map[string]map[string][]byte)
+	b.count = 0
+	return nil
+}
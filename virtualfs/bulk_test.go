@@ -0,0 +1,49 @@
+package virtualfs
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBulkLoader_ViewPending(t *testing.T) {
+	if err := InitVirtualFs(filepath.Join(t.TempDir(), "blocks_mapping.db"), false); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	const repoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	path := StorePath(repoId, "") + "/a.txt"
+	oldBlk, newBlk := strings.Repeat("a", 40), strings.Repeat("b", 40)
+	b := NewBulkLoader(1000)
+	put := func(mtime int64, blk string) {
+		info := &RealFileInfo{Size: 10, Mtime: mtime, FileID: strings.Repeat("f", 40), BlkIDs: []string{blk}, Sums: [][]byte{make([]byte, 32)}}
+		if err := b.PutFile(repoId, path, info, 1024, ProxyContent); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(m Mapper, stage string, mapped bool) {
+		err := m.View(func(v *MappingView) error {
+			info, err := v.RealFileInfo(path)
+			if err != nil {
+				return err
+			}
+			blkPath := ProxyPath(repoId, newBlk)
+			if got := info != nil && info.Mtime == 2 && v.ProxyExists(blkPath) && v.ProxyOwner(blkPath) == path &&
+				v.HasChecksum(blkPath) && v.IsStale(ProxyPath(repoId, oldBlk)); got != mapped {
+				t.Errorf("%s: mapping of the changed file is %v, want %v", stage, got, mapped)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	put(1, oldBlk)
+	put(2, newBlk)
+	check(b, "before flush", true)
+	check(NewMapper(), "batch view before flush", false)
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	check(NewMapper(), "after flush", true)
+}
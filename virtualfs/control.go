@@ -0,0 +1,289 @@
+package virtualfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A mount holds the lock of the mapping while it serves it, a scan needs it for itself. The mount listens on
+// the control socket next to the mapping; a scan asks it there to release the mapping, and the mount closes
+// it until the scan hands it back, or serves a snapshot of it if it was started with one. The mount then
+// reopens the mapping and invalidates the kernel caches of the entries the scan changed.
+
+const (
+	controlRelease = "release"
+	controlReload  = "reload"
+	controlOk      = "ok"
+)
+
+// errReleased is returned for the mapping of a mount that released it to a scan without a snapshot.
+var errReleased = fmt.Errorf("mapping is released to a scan: %w", syscall.EAGAIN)
+
+// borrowed is the connection to the mount that released the mapping to this process.
+var borrowed net.Conn
+
+// ControlPath returns the path of the control socket of the mount serving the mapping at file.
+func ControlPath(file string) string {
+	return file + ".sock"
+}
+
+func snapshotPath(file string) string {
+	return file + ".snapshot"
+}
+
+// Borrow asks a mount serving the mapping at file to release it, Close hands it back.
+// Without a mount listening on the control socket it does nothing.
+func Borrow(file string) error {
+	conn, err := net.Dial("unix", ControlPath(file))
+	if err != nil {
+		return nil
+	}
+	if err = request(conn, bufio.NewReader(conn), controlRelease); err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("ask mount to release %s: %w", file, err)
+	}
+	logger.Info("mount released the mapping", zap.String("path", file))
+	borrowed = conn
+	return nil
+}
+
+// giveBack hands the mapping back to the mount it was borrowed from, once it is closed.
+func giveBack() {
+	if borrowed == nil {
+		return
+	}
+	defer func() {
+		_ = borrowed.Close()
+		borrowed = nil
+	}()
+	if err := request(borrowed, bufio.NewReader(borrowed), controlReload); err != nil {
+		logger.Warn("hand mapping back to mount occur error", zap.Error(err))
+	}
+}
+
+func request(conn net.Conn, r *bufio.Reader, command string) error {
+	if _, err := fmt.Fprintln(conn, command); err != nil {
+		return err
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimSpace(line); line != controlOk {
+		return errors.New(line)
+	}
+	return nil
+}
+
+// controlServer hands the mapping of a mount over to scans.
+type controlServer struct {
+	fsys    *fuseFs
+	mu      sync.Mutex
+	holders int
+}
+
+// serveControl listens on the control socket of the mapping until ctx is done.
+func serveControl(ctx context.Context, fsys *fuseFs) {
+	path := ControlPath(dbFile)
+	// Only the owner of the mount may make it release the mapping, the socket is restricted before it is
+	// moved where scans look for it. It replaces a socket left over by a mount that did not stop cleanly.
+	tmp := path + ".tmp"
+	_ = os.Remove(tmp)
+	listener, err := net.Listen("unix", tmp)
+	if err == nil {
+		if err = os.Chmod(tmp, 0600); err == nil {
+			err = os.Rename(tmp, path)
+		}
+		if err != nil {
+			_ = listener.Close()
+		}
+	}
+	if err != nil {
+		logger.Warn("listen on control socket occur error, scans must wait for the unmount", zap.Error(err), zap.String("path", path))
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+		_ = os.Remove(path)
+	}()
+	c := &controlServer{fsys: fsys}
+	for {
+		conn, aErr := listener.Accept()
+		if aErr != nil {
+			if ctx.Err() == nil {
+				logger.Warn("accept on control socket occur error", zap.Error(aErr))
+			}
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *controlServer) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != controlRelease {
+		return
+	}
+	if err = c.acquire(); err != nil {
+		logger.Warn("release mapping occur error", zap.Error(err))
+		_, _ = fmt.Fprintln(conn, err.Error())
+		return
+	}
+	_, _ = fmt.Fprintln(conn, controlOk)
+	// The scan keeps the mapping until it hands it back or goes away.
+	_, _ = r.ReadString('\n')
+	if err = c.release(); err != nil {
+		logger.Warn("reload mapping occur error", zap.Error(err))
+		_, _ = fmt.Fprintln(conn, err.Error())
+		return
+	}
+	_, _ = fmt.Fprintln(conn, controlOk)
+}
+
+func (c *controlServer) acquire() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.holders == 0 {
+		if err := releaseDB(c.fsys.snapshot); err != nil {
+			return err
+		}
+	}
+	c.holders++
+	return nil
+}
+
+func (c *controlServer) release() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.holders--; c.holders > 0 {
+		return nil
+	}
+	if err := reloadDB(); err != nil {
+		return err
+	}
+	c.fsys.invalidate()
+	return nil
+}
+
+// releaseDB closes the mapping, reads of it fail with errReleased until reloadDB. With snapshot the mapping
+// is replaced with a read-only copy of it instead, the copy keeps no lock on the mapping but is as large.
+func releaseDB(snapshot bool) error {
+	if !snapshot {
+		swapDB(nil)
+		logger.Info("mapping released", zap.String("path", dbFile))
+		return nil
+	}
+	file := snapshotPath(dbFile)
+	err := view(func(tx *bbolt.Tx) error {
+		return tx.CopyFile(file, 0600)
+	})
+	if err != nil {
+		return fmt.Errorf("snapshot mapping: %w", err)
+	}
+	d, err := openDB(file, true)
+	if err != nil {
+		return err
+	}
+	swapDB(d)
+	logger.Info("mapping released, serving snapshot", zap.String("path", file))
+	return nil
+}
+
+// reloadDB reopens the mapping released by releaseDB.
+func reloadDB() error {
+	d, err := openDB(dbFile, dbReadOnly)
+	if err != nil {
+		return err
+	}
+	swapDB(d)
+	_ = os.Remove(snapshotPath(dbFile))
+	logger.Info("mapping reloaded", zap.String("path", dbFile))
+	// The scan moved the stale log into the mapping.
+	return loadStaleLog()
+}
+
+func swapDB(d *bbolt.DB) {
+	dbLock.Lock()
+	old := db
+	db = d
+	dbLock.Unlock()
+	if old != nil {
+		_ = old.Close()
+	}
+}
+
+// track remembers a node handed to the kernel, so it can be invalidated when the mapping is reloaded.
+func (f *fuseFs) track(path string, node fs.Node) fs.Node {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.nodes == nil {
+		f.nodes = make(map[string]fs.Node)
+	}
+	f.nodes[path] = node
+	return node
+}
+
+// forget drops a node the kernel forgot, unless a newer node of path replaced it.
+func (f *fuseFs) forget(path string, node fs.Node) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.nodes[path] == node {
+		delete(f.nodes, path)
+	}
+}
+
+// invalidate drops the kernel caches of the entries that changed in the mapping. The listings of all known
+// directories are dropped, so new entries show up.
+func (f *fuseFs) invalidate() {
+	if f.server == nil {
+		return
+	}
+	f.mu.Lock()
+	nodes := make(map[string]fs.Node, len(f.nodes))
+	for path, node := range f.nodes {
+		nodes[path] = node
+	}
+	f.mu.Unlock()
+	for path, node := range nodes {
+		var isDir bool
+		var size, offset, mtime int64
+		var fId uint64
+		err := Lookup(path, &isDir, &size, &offset, &fId, &mtime)
+		// The root is not an entry of the mapping.
+		changed := err != nil && path != f.path
+		if file, ok := node.(*FileNode); ok && err == nil {
+			changed = isDir || file.size != size || file.offset != offset || file.id != fId || file.mtime != mtime
+		}
+		if changed {
+			if parent, ok := nodes[filepath.Dir(path)]; ok {
+				f.invalidateError(f.server.InvalidateEntry(parent, filepath.Base(path)), path)
+			}
+			f.forget(path, node)
+		}
+		if _, ok := node.(*DirNode); ok || changed {
+			f.invalidateError(f.server.InvalidateNodeData(node), path)
+		}
+	}
+}
+
+func (f *fuseFs) invalidateError(err error, path string) {
+	if err != nil && !errors.Is(err, fuse.ErrNotCached) {
+		logger.Warn("invalidate kernel cache occur error", zap.Error(err), zap.String("path", path))
+	}
+}
@@ -0,0 +1,90 @@
+package virtualfs
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"go.etcd.io/bbolt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestControl(t *testing.T) {
+	for _, snapshot := range []bool{false, true} {
+		testControl(t, snapshot)
+	}
+}
+
+func testControl(t *testing.T, snapshot bool) {
+	file := filepath.Join(t.TempDir(), "blocks_mapping.db")
+	if err := InitVirtualFs(file, false); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if err := InitVirtualFs(file, true); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go serveControl(ctx, &fuseFs{path: "/", snapshot: snapshot})
+	var conn net.Conn
+	var err error
+	for i := 0; i < 100; i++ {
+		if conn, err = net.Dial("unix", ControlPath(file)); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if info, err := os.Stat(ControlPath(file)); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("control socket %v, %v, want mode 0600", info, err)
+	}
+	r := bufio.NewReader(conn)
+	if err = request(conn, r, controlRelease); err != nil {
+		t.Fatal(err)
+	}
+	// The mount keeps no lock on the mapping, a scan can write it.
+	scan, err := bbolt.Open(file, os.ModePerm, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxyPath := ProxyPath("11a6e0ac-a8be-42ea-ac71-67472ce2710a", "ab"+strings.Repeat("1", 38))
+	err = scan.Update(func(tx *bbolt.Tx) error {
+		return WriteContentProxyFile(tx, proxyPath, 1, 0, 10, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = scan.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The snapshot does not have the entries of the scan, without one the mapping can not be read.
+	want := syscall.EAGAIN
+	if snapshot {
+		want = syscall.ENOENT
+	}
+	if _, err = GetProxy(proxyPath); !errors.Is(err, want) {
+		t.Errorf("snapshot %v: proxy of the released mapping returned %v, want %v", snapshot, err, want)
+	}
+	if _, err = os.Stat(snapshotPath(file)); os.IsNotExist(err) == snapshot {
+		t.Errorf("snapshot %v: snapshot file returned %v", snapshot, err)
+	}
+	if err = request(conn, r, controlReload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = GetProxy(proxyPath); err != nil {
+		t.Errorf("snapshot %v: proxy after reload returned %v", snapshot, err)
+	}
+	if _, err = os.Stat(snapshotPath(file)); !os.IsNotExist(err) {
+		t.Errorf("snapshot %v: snapshot left after reload: %v", snapshot, err)
+	}
+}
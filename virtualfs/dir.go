@@ -20,12 +20,15 @@ type DirNode struct {
 func (f *DirNode) Attr(ctx context.Context, attr *fuse.Attr) error {
 	logger.Debug("attr dir", zap.String("path", f.path))
 	attr.Mode = os.ModeDir | 0o555
+	if f.fs.overlay != "" {
+		attr.Mode = os.ModeDir | 0o755
+	}
 	return nil
 }
 
 func (f *DirNode) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	logger.Debug("read dir all", zap.String("path", f.path))
-	data, err := ListDir(f.path)
+	data, err := f.readDirBacking(ListDir(f.path))
 	if err != nil {
 		logger.Warn("list dir occur error", zap.Error(err), zap.String("path", f.path))
 		return nil, err
@@ -42,13 +45,16 @@ func (f *DirNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
 	var fId uint64
 	var mtime int64
 	logger.Debug("lookup", zap.String("path", path))
+	if node, err := f.lookupBacking(path); node != nil || err != nil {
+		return node, err
+	}
 	err := Lookup(path, &isDir, &size, &offset, &fId, &mtime)
 	if err != nil {
 		logger.Warn("lookup occur error", zap.Error(err), zap.String("path", path))
 		return nil, err
 	}
 	if isDir {
-		return &DirNode{path: path, fs: f.fs, mtime: mtime}, nil
+		return f.fs.track(path, &DirNode{path: path, fs: f.fs, mtime: mtime}), nil
 	} else {
 		if size < 0 || offset < 0 || mtime < 0 {
 			logger.Warn("lookup get invalid data", zap.Error(err),
@@ -59,6 +65,10 @@ func (f *DirNode) Lookup(ctx context.Context, name string) (fs.Node, error) {
 			)
 			return nil, syscall.EIO
 		}
-		return &FileNode{fs: f.fs, path: path, id: fId, size: size, offset: offset, mtime: mtime}, nil
+		return f.fs.track(path, &FileNode{fs: f.fs, path: path, id: fId, size: size, offset: offset, mtime: mtime}), nil
 	}
 }
+
+func (f *DirNode) Forget() {
+	f.fs.forget(f.path, f)
+}
@@ -7,7 +7,6 @@ import (
 	"github.com/manx98/local_to_seaf_store/logger"
 	"go.uber.org/zap"
 	"os"
-	"path/filepath"
 	"syscall"
 	"time"
 )
@@ -30,6 +29,10 @@ func (f *FileNode) Attr(ctx context.Context, attr *fuse.Attr) error {
 	return nil
 }
 
+func (f *FileNode) Forget() {
+	f.fs.forget(f.path, f)
+}
+
 func (f *FileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
 	logger.Debug("open file",
 		zap.Uint64("id", f.id),
@@ -43,7 +46,7 @@ func (f *FileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.O
 	if req.Flags&fuse.OpenDirectory == fuse.OpenDirectory {
 		return nil, syscall.ENOTSUP
 	}
-	path, err := GetRealFilePath(f.id)
+	path, err := f.fs.roots.Resolve(f.id)
 	if err != nil {
 		logger.Warn("open file occur error",
 			zap.Uint64("id", f.id),
@@ -54,7 +57,6 @@ func (f *FileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.O
 		)
 		return nil, err
 	}
-	path = filepath.Join(f.fs.pathPrefix, path)
 	resp.Flags |= fuse.OpenKeepCache
 	handle := &FileHandle{node: f}
 	handle.f, err = os.OpenFile(path, os.O_RDONLY, 0644)
@@ -72,9 +74,61 @@ func (f *FileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.O
 		}
 		return nil, err
 	}
+	if err = f.verify(handle.f); err != nil {
+		_ = handle.f.Close()
+		return nil, err
+	}
 	return handle, nil
 }
 
+// verify checks that the real file is still the one scanned, a changed file would serve wrong block data.
+// The proxy file of a changed real file is added to the stale set.
+func (f *FileNode) verify(file *os.File) error {
+	stale, recorded, err := proxyState(f.path, f.id)
+	if err != nil {
+		logger.Warn("get proxy state occur error", zap.String("m_path", f.path), zap.Error(err))
+		return syscall.EIO
+	}
+	if stale {
+		logger.Warn("open stale proxy file", zap.String("m_path", f.path), zap.String("r_path", file.Name()))
+		return syscall.EIO
+	}
+	info, err := file.Stat()
+	if err != nil {
+		logger.Warn("stat real file occur error", zap.String("r_path", file.Name()), zap.Error(err))
+		return syscall.EIO
+	}
+	cur := NewRealFileInfo(info)
+	changed := cur.Mtime != f.mtime || cur.Size < f.offset+f.size
+	if !changed && recorded != nil {
+		changed = !recorded.Unchanged(cur)
+	}
+	if !changed {
+		return nil
+	}
+	fields := []zap.Field{
+		zap.String("m_path", f.path),
+		zap.String("r_path", file.Name()),
+		zap.Int64("size", cur.Size),
+		zap.Int64("mtime", cur.Mtime),
+		zap.Uint64("ino", cur.Ino),
+		zap.Int64("ctime", cur.Ctime),
+		zap.Int64("scan_mtime", f.mtime),
+	}
+	if recorded != nil {
+		fields = append(fields,
+			zap.Int64("scan_size", recorded.Size),
+			zap.Uint64("scan_ino", recorded.Ino),
+			zap.Int64("scan_ctime", recorded.Ctime),
+		)
+	}
+	logger.Error("real file changed since the scan, proxy file is stale", fields...)
+	if err = markStale(f.path); err != nil {
+		logger.Warn("mark proxy file stale occur error", zap.String("m_path", f.path), zap.Error(err))
+	}
+	return syscall.EIO
+}
+
 type FileHandle struct {
 	node *FileNode
 	f    *os.File
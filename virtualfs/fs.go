@@ -3,12 +3,15 @@ package virtualfs
 import (
 	"bazil.org/fuse"
 	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/manx98/local_to_seaf_store/logger"
 	"go.etcd.io/bbolt"
 	"go.uber.org/zap"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -16,37 +19,123 @@ import (
 var db *bbolt.DB
 var globalId uint64
 
+// dbLock guards db against the swap of a mount that hands the mapping to a scan.
+var dbLock sync.RWMutex
+var dbFile string
+var dbReadOnly bool
+
+// lockTimeout is how long opening the mapping waits for the lock of another process.
+const lockTimeout = 30 * time.Second
+
 const (
 	RealPathToIdBucketName = "RTI"
 	IdToRealPathBucketName = "ITR"
+	RealFileInfoBucketName = "RFI"
+	StaleBucketName        = "STALE"
+	// TombstoneBucketName holds the mapping entries deleted through an overlay mount.
+	TombstoneBucketName = "TOMBSTONE"
+	// ChecksumBucketName maps proxy file paths to the SHA-256 of their data, recorded by scans with checksums.
+	ChecksumBucketName = "SUM"
 )
 
-func InitVirtualFs(dbFile string, readOnly bool) (err error) {
-	db, err = bbolt.Open(dbFile, os.ModePerm, &bbolt.Options{
-		NoSync:   true,
-		ReadOnly: readOnly,
-	})
+// RealFileInfo records the state of a real file at the time it was scanned
+// and the seafile objects generated for it.
+type RealFileInfo struct {
+	Size  int64
+	Mtime int64
+	// Ino and Ctime are 0 if the scan did not record them.
+	Ino    uint64
+	Ctime  int64
+	FileID string
+	BlkIDs []string
+	// Sums are the SHA-256 of the blocks, nil if the scan did not compute them.
+	// They are kept in the checksum bucket, not in the info of the file.
+	Sums [][]byte
+}
+
+// NewRealFileInfo returns the state of the real file described by info, without objects.
+func NewRealFileInfo(info os.FileInfo) *RealFileInfo {
+	ino, ctime := fileIdentity(info)
+	return &RealFileInfo{Size: info.Size(), Mtime: info.ModTime().Unix(), Ino: ino, Ctime: ctime}
+}
+
+// Unchanged reports whether the real file in state cur is still the one recorded in i.
+// The inode and ctime are only compared if both sides have them.
+func (i *RealFileInfo) Unchanged(cur *RealFileInfo) bool {
+	if i.Size != cur.Size || i.Mtime != cur.Mtime {
+		return false
+	}
+	if i.Ino != 0 && cur.Ino != 0 && i.Ino != cur.Ino {
+		return false
+	}
+	return i.Ctime == 0 || cur.Ctime == 0 || i.Ctime == cur.Ctime
+}
+
+func InitVirtualFs(file string, readOnly bool) (err error) {
+	dbFile, dbReadOnly = file, readOnly
+	db, err = openDB(file, readOnly)
 	if err != nil {
-		return fmt.Errorf("create db: %w", err)
+		return err
 	}
 	if !readOnly {
 		globalId, err = LastRealFileId()
 		if err != nil {
 			return fmt.Errorf("get last real file globalId: %w", err)
 		}
-		err = db.Batch(func(tx *bbolt.Tx) error {
-			_, cErr := tx.CreateBucketIfNotExists([]byte(RealPathToIdBucketName))
-			if cErr != nil {
-				return fmt.Errorf("create %s bucket: %w", RealPathToIdBucketName, cErr)
-			}
-			_, cErr = tx.CreateBucketIfNotExists([]byte(IdToRealPathBucketName))
-			if cErr != nil {
-				return fmt.Errorf("create %s bucket: %w", IdToRealPathBucketName, cErr)
+		err = batch(func(tx *bbolt.Tx) error {
+			for _, name := range []string{RealPathToIdBucketName, IdToRealPathBucketName, RealFileInfoBucketName, StaleBucketName, JournalBucketName, RootsBucketName, TombstoneBucketName, ChecksumBucketName} {
+				if _, cErr := tx.CreateBucketIfNotExists([]byte(name)); cErr != nil {
+					return fmt.Errorf("create %s bucket: %w", name, cErr)
+				}
 			}
 			return nil
 		})
+		if err != nil {
+			return
+		}
 	}
-	return
+	return loadStaleLog()
+}
+
+func openDB(file string, readOnly bool) (*bbolt.DB, error) {
+	d, err := bbolt.Open(file, os.ModePerm, &bbolt.Options{
+		NoSync:   true,
+		ReadOnly: readOnly,
+		Timeout:  lockTimeout,
+	})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s is locked by another scan or by a mount that can not release it: %w", file, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("create db: %w", err)
+	}
+	return d, nil
+}
+
+func view(fn func(*bbolt.Tx) error) error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if db == nil {
+		return errReleased
+	}
+	return db.View(fn)
+}
+
+func update(fn func(*bbolt.Tx) error) error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if db == nil {
+		return errReleased
+	}
+	return db.Update(fn)
+}
+
+func batch(fn func(*bbolt.Tx) error) error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if db == nil {
+		return errReleased
+	}
+	return db.Batch(fn)
 }
 
 func mkdirAll(tx *bbolt.Tx, dir string) (err error) {
@@ -89,12 +178,15 @@ func MkdirAll(tx *bbolt.Tx, dir string) error {
 }
 
 func ListDir(parent string) (direntList []fuse.Dirent, err error) {
-	err = db.View(func(tx *bbolt.Tx) error {
+	err = view(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(parent))
 		if bucket == nil {
 			return syscall.ENOENT
 		}
 		err = bucket.ForEach(func(name, data []byte) error {
+			if isTombstone(tx, filepath.Join(parent, string(name))) {
+				return nil
+			}
 			dirent := fuse.Dirent{Name: string(name)}
 			if data[len(data)-1] == 0 {
 				dirent.Type = fuse.DT_Dir
@@ -109,7 +201,36 @@ func ListDir(parent string) (direntList []fuse.Dirent, err error) {
 	return
 }
 
+// Kinds of proxy file, stored in the last byte of a mapping entry. Directories use 0.
+const (
+	// ProxyRandom is a proxy file whose block id is random.
+	ProxyRandom byte = 1
+	// ProxyContent is a proxy file whose block id is the SHA-1 of its content.
+	ProxyContent byte = 2
+)
+
 func WriteProxyFile(tx *bbolt.Tx, path string, readPathId uint64, offset int64, size int64, mtime int64) error {
+	return writeProxyFile(tx, path, readPathId, offset, size, mtime, ProxyRandom, false)
+}
+
+// WriteContentProxyFile writes a proxy file whose block id is derived from its content.
+// An existing proxy file at path of the same real file is kept, unless it is stale. One of another real file
+// holds the same content too, it is taken over so that it goes stale with this file and not with the other.
+func WriteContentProxyFile(tx *bbolt.Tx, path string, readPathId uint64, offset int64, size int64, mtime int64) error {
+	if pointsTo(proxyEntry(tx, path), readPathId) && !IsStale(tx, path) && !isTombstone(tx, path) && !isTombstone(tx, filepath.Dir(path)) {
+		return nil
+	}
+	err := writeProxyFile(tx, path, readPathId, offset, size, mtime, ProxyContent, true)
+	if err != nil {
+		return err
+	}
+	if bucket := tx.Bucket([]byte(StaleBucketName)); bucket != nil {
+		return bucket.Delete([]byte(path))
+	}
+	return nil
+}
+
+func writeProxyFile(tx *bbolt.Tx, path string, readPathId uint64, offset int64, size int64, mtime int64, kind byte, overwrite bool) error {
 	parent := filepath.Dir(path)
 	err := MkdirAll(tx, parent)
 	if err != nil {
@@ -119,21 +240,39 @@ func WriteProxyFile(tx *bbolt.Tx, path string, readPathId uint64, offset int64,
 	if bucket == nil {
 		return syscall.ENOENT
 	}
+	data := encodeProxyFile(readPathId, offset, size, mtime, kind)
+	fileName := []byte(filepath.Base(path))
+	if old := bucket.Get(fileName); old != nil && (!overwrite || old[len(old)-1] == 0) {
+		return syscall.EEXIST
+	}
+	if err = bucket.Put(fileName, data); err != nil {
+		return err
+	}
+	// A block written again by a scan is visible again, and so is its directory.
+	if tombstones := tx.Bucket([]byte(TombstoneBucketName)); tombstones != nil {
+		if err = tombstones.Delete([]byte(path)); err == nil {
+			err = tombstones.Delete([]byte(parent))
+		}
+	}
+	return err
+}
+
+func encodeProxyFile(readPathId uint64, offset int64, size int64, mtime int64, kind byte) []byte {
 	data := make([]byte, 33)
 	binary.BigEndian.PutUint64(data, readPathId)
 	binary.BigEndian.PutUint64(data[8:], uint64(offset))
 	binary.BigEndian.PutUint64(data[16:], uint64(size))
 	binary.BigEndian.PutUint64(data[24:], uint64(mtime))
-	data[32] = 1
-	fileName := []byte(filepath.Base(path))
-	if bucket.Get(fileName) != nil {
-		return syscall.EEXIST
-	}
-	return bucket.Put(fileName, data)
+	data[32] = kind
+	return data
+}
+
+func staleTime() []byte {
+	return binary.BigEndian.AppendUint64([]byte{}, uint64(time.Now().Unix()))
 }
 
 func DeleteFile(path string) error {
-	return db.Batch(func(tx *bbolt.Tx) error {
+	return batch(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(filepath.Dir(path)))
 		if bucket == nil {
 			return nil
@@ -143,7 +282,7 @@ func DeleteFile(path string) error {
 }
 
 func DeleteDir(path string) error {
-	return db.Batch(func(tx *bbolt.Tx) error {
+	return batch(func(tx *bbolt.Tx) error {
 		err := tx.DeleteBucket([]byte(path))
 		if err == nil {
 			bucket := tx.Bucket([]byte(filepath.Dir(path)))
@@ -156,13 +295,13 @@ func DeleteDir(path string) error {
 }
 
 func Lookup(path string, isDir *bool, size *int64, offset *int64, fId *uint64, mtime *int64) error {
-	return db.View(func(tx *bbolt.Tx) error {
+	return view(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(filepath.Dir(path)))
 		if bucket == nil {
 			return syscall.ENOENT
 		}
 		data := bucket.Get([]byte(filepath.Base(path)))
-		if data == nil {
+		if data == nil || isTombstone(tx, path) {
 			return syscall.ENOENT
 		}
 		if data[len(data)-1] == 0 {
@@ -178,6 +317,44 @@ func Lookup(path string, isDir *bool, size *int64, offset *int64, fId *uint64, m
 	})
 }
 
+// Proxy is a proxy file of the block mapping.
+type Proxy struct {
+	RealFileId uint64
+	Offset     int64
+	Size       int64
+	// Mtime is the mtime of the real file when it was scanned.
+	Mtime int64
+	Kind  byte
+	Stale bool
+}
+
+// GetProxy returns the proxy file at path, or syscall.ENOENT if there is none.
+func GetProxy(path string) (proxy *Proxy, err error) {
+	err = view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(filepath.Dir(path)))
+		if bucket == nil {
+			return syscall.ENOENT
+		}
+		data := bucket.Get([]byte(filepath.Base(path)))
+		if data == nil || data[len(data)-1] == 0 || isTombstone(tx, path) {
+			return syscall.ENOENT
+		}
+		if len(data) != 33 {
+			return fmt.Errorf("invalid proxy file %s: %w", path, syscall.EIO)
+		}
+		proxy = &Proxy{
+			RealFileId: binary.BigEndian.Uint64(data),
+			Offset:     int64(binary.BigEndian.Uint64(data[8:])),
+			Size:       int64(binary.BigEndian.Uint64(data[16:])),
+			Mtime:      int64(binary.BigEndian.Uint64(data[24:])),
+			Kind:       data[32],
+			Stale:      IsStale(tx, path),
+		}
+		return nil
+	})
+	return
+}
+
 func PutRealFilePath(tx *bbolt.Tx, path []byte) (id uint64, err error) {
 	rTiBucket := tx.Bucket([]byte(RealPathToIdBucketName))
 	if rTiBucket == nil {
@@ -205,8 +382,143 @@ func PutRealFilePath(tx *bbolt.Tx, path []byte) (id uint64, err error) {
 	return
 }
 
+// GetRealFileInfo returns the info recorded by the last scan of path, or nil if the path was never scanned.
+func GetRealFileInfo(tx *bbolt.Tx, path []byte) (*RealFileInfo, error) {
+	bucket := tx.Bucket([]byte(RealFileInfoBucketName))
+	if bucket == nil {
+		return nil, nil
+	}
+	return decodeRealFileInfo(path, bucket.Get(path))
+}
+
+func decodeRealFileInfo(path []byte, data []byte) (*RealFileInfo, error) {
+	if data == nil {
+		return nil, nil
+	}
+	// The inode and ctime follow the block ids, entries of older scans have none.
+	end := len(data)
+	if len(data) >= 36 && (len(data)-36)%20 == 16 {
+		end -= 16
+	}
+	if len(data) < 36 || (end-36)%20 != 0 {
+		logger.Error("invalid real file info", zap.ByteString("path", path))
+		return nil, syscall.EIO
+	}
+	info := &RealFileInfo{
+		Size:   int64(binary.BigEndian.Uint64(data)),
+		Mtime:  int64(binary.BigEndian.Uint64(data[8:])),
+		FileID: hex.EncodeToString(data[16:36]),
+	}
+	if end < len(data) {
+		info.Ino = binary.BigEndian.Uint64(data[end:])
+		info.Ctime = int64(binary.BigEndian.Uint64(data[end+8:]))
+	}
+	for i := 36; i < end; i += 20 {
+		info.BlkIDs = append(info.BlkIDs, hex.EncodeToString(data[i:i+20]))
+	}
+	return info, nil
+}
+
+// PutRealFileInfo records the info of a scanned real file.
+func PutRealFileInfo(tx *bbolt.Tx, path []byte, info *RealFileInfo) error {
+	bucket := tx.Bucket([]byte(RealFileInfoBucketName))
+	if bucket == nil {
+		return fmt.Errorf("%s bucket not exist: %w", RealFileInfoBucketName, syscall.EIO)
+	}
+	data, err := encodeRealFileInfo(info)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(path, data)
+}
+
+func encodeRealFileInfo(info *RealFileInfo) ([]byte, error) {
+	data := make([]byte, 36+len(info.BlkIDs)*20)
+	binary.BigEndian.PutUint64(data, uint64(info.Size))
+	binary.BigEndian.PutUint64(data[8:], uint64(info.Mtime))
+	if _, err := hex.Decode(data[16:36], []byte(info.FileID)); err != nil {
+		return nil, fmt.Errorf("decode file id %s: %w", info.FileID, err)
+	}
+	for i, blkId := range info.BlkIDs {
+		if _, err := hex.Decode(data[36+i*20:56+i*20], []byte(blkId)); err != nil {
+			return nil, fmt.Errorf("decode block id %s: %w", blkId, err)
+		}
+	}
+	if info.Ino != 0 || info.Ctime != 0 {
+		data = binary.BigEndian.AppendUint64(data, info.Ino)
+		data = binary.BigEndian.AppendUint64(data, uint64(info.Ctime))
+	}
+	return data, nil
+}
+
+// ProxyPath returns the path of a block in the mapping.
+func ProxyPath(repoId, blkId string) string {
+	return filepath.Join("/", repoId, blkId[:2], blkId[2:])
+}
+
+func proxyEntry(tx *bbolt.Tx, path string) []byte {
+	bucket := tx.Bucket([]byte(filepath.Dir(path)))
+	if bucket == nil {
+		return nil
+	}
+	return bucket.Get([]byte(filepath.Base(path)))
+}
+
+// pointsTo reports whether the mapping entry data is a proxy file of the real file id.
+func pointsTo(data []byte, id uint64) bool {
+	return len(data) == 33 && data[32] != 0 && binary.BigEndian.Uint64(data) == id
+}
+
+// staleWith reports whether the proxy file entry data goes stale when the real file id changes. A content-addressed
+// proxy file is shared by the files with the same content, it only goes stale with the file it points to.
+func staleWith(data []byte, id uint64) bool {
+	return len(data) == 33 && (data[32] == ProxyRandom || pointsTo(data, id))
+}
+
+// ProxyExists checks whether a proxy file exists at path.
+func ProxyExists(tx *bbolt.Tx, path string) bool {
+	bucket := tx.Bucket([]byte(filepath.Dir(path)))
+	if bucket == nil {
+		return false
+	}
+	data := bucket.Get([]byte(filepath.Base(path)))
+	return data != nil && data[len(data)-1] != 0
+}
+
+// MarkStale adds the proxy file at path to the stale set, the real data it
+// points to no longer matches what was scanned.
+func MarkStale(tx *bbolt.Tx, path string) error {
+	bucket := tx.Bucket([]byte(StaleBucketName))
+	if bucket == nil {
+		return fmt.Errorf("%s bucket not exist: %w", StaleBucketName, syscall.EIO)
+	}
+	return bucket.Put([]byte(path), staleTime())
+}
+
+// IsStale checks whether the proxy file at path is in the stale set.
+func IsStale(tx *bbolt.Tx, path string) bool {
+	bucket := tx.Bucket([]byte(StaleBucketName))
+	return bucket != nil && bucket.Get([]byte(path)) != nil || staleLogged(path)
+}
+
+// PutTombstone hides the entry at path of the mapping, it was deleted through an overlay mount.
+func PutTombstone(path string) error {
+	return batch(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(TombstoneBucketName))
+		if bucket == nil {
+			return fmt.Errorf("%s bucket not exist: %w", TombstoneBucketName, syscall.EIO)
+		}
+		return bucket.Put([]byte(path), staleTime())
+	})
+}
+
+func isTombstone(tx *bbolt.Tx, path string) bool {
+	bucket := tx.Bucket([]byte(TombstoneBucketName))
+	return bucket != nil && bucket.Get([]byte(path)) != nil
+}
+
 func LastRealFileId() (id uint64, err error) {
-	err = db.Batch(func(tx *bbolt.Tx) error {
+	err = batch(func(tx *bbolt.Tx) error {
 		bucket, cErr := tx.CreateBucketIfNotExists([]byte("ID"))
 		if cErr != nil {
 			return cErr
@@ -231,8 +543,9 @@ func UpdateNextId(tx *bbolt.Tx, id uint64) error {
 	return err
 }
 
+// GetRealFilePath returns the path recorded by a scan for the real file id, see SplitStorePath.
 func GetRealFilePath(id uint64) (path string, err error) {
-	err = db.View(func(tx *bbolt.Tx) error {
+	err = view(func(tx *bbolt.Tx) error {
 		bucket := tx.Bucket([]byte(IdToRealPathBucketName))
 		if bucket == nil {
 			return syscall.EIO
@@ -245,25 +558,33 @@ func GetRealFilePath(id uint64) (path string, err error) {
 			logger.Error("invalid real path", zap.ByteString("path", pathData))
 			return syscall.EIO
 		}
-		path = string(pathData[36:])
-		if path == "" {
-			return syscall.ENOENT
-		}
+		path = string(pathData)
 		return nil
 	})
 	return
 }
 
 func Sync() error {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
 	return db.Sync()
 }
 
+// Close closes the mapping and hands it back to the mount it was borrowed from, see Borrow.
 func Close() {
+	dbLock.Lock()
 	if db != nil {
 		_ = db.Close()
+		db = nil
 	}
+	dbLock.Unlock()
+	giveBack()
 }
 
 func Batch(fn func(*bbolt.Tx) error) error {
-	return db.Batch(fn)
+	return batch(fn)
+}
+
+func View(fn func(*bbolt.Tx) error) error {
+	return view(fn)
 }
@@ -7,7 +7,7 @@ import (
 )
 
 func TestInitVirtualFs(t *testing.T) {
-	err := InitVirtualFs("/tmp/blocks_mapping.db")
+	err := InitVirtualFs("/tmp/blocks_mapping.db", false)
 	if err != nil {
 		t.Fatal(err)
 	}
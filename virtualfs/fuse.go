@@ -5,23 +5,64 @@ import (
 	"bazil.org/fuse/fs"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/manx98/local_to_seaf_store/logger"
 	"go.uber.org/zap"
 	"log"
 	"os"
+	"sync"
 	"syscall"
 )
 
 type fuseFs struct {
-	path       string
-	pathPrefix string
+	path  string
+	roots *RootResolver
+	// overlay is the backing directory of a writable mount, empty for a read-only mount.
+	overlay string
+	// snapshot makes the mount serve a copy of the mapping while a scan holds it, see releaseDB.
+	snapshot bool
+	server   *fs.Server
+	mu       sync.Mutex
+	// nodes are the mapping nodes handed to the kernel by path, see invalidate.
+	nodes map[string]fs.Node
 }
 
 func (f *fuseFs) Root() (fs.Node, error) {
-	return &DirNode{path: f.path, fs: f}, nil
+	return f.track(f.path, &DirNode{path: f.path, fs: f}), nil
 }
 
-func Mount(ctx context.Context, pathPrefix, mountPoint, repoId string, allowOther bool) {
+// Mount serves the proxy files of repoId at mountPoint, reading the real files from the source roots of roots.
+// With an overlay directory the mount is writable, new files are kept in overlay and the mapping must be open
+// for writing to record deletions. With snapshot the mount serves a copy of the mapping while a scan holds it.
+func Mount(ctx context.Context, roots *RootResolver, mountPoint, repoId string, allowOther bool, overlay string, snapshot bool) {
+	prepareMountPoint(mountPoint)
+	options := mountOptions(allowOther)
+	if overlay == "" {
+		options = append(options, fuse.ReadOnly())
+	} else if err := os.MkdirAll(overlay, 0755); err != nil {
+		logger.Fatal("mkdir overlay occur error", zap.Error(err))
+	}
+	serve(ctx, mountPoint, options, &fuseFs{roots: roots, path: "/" + repoId, overlay: overlay, snapshot: snapshot})
+}
+
+// MountAll serves every repo of the mapping at mountPoint, the blocks directory of the seafile storage.
+// The blocks directory under the mount is the backing directory, so native repos pass through to it and
+// new blocks are written there. Repos are read from the mapping on every lookup, a repo recorded by a
+// scan shows up without a new mount. The mapping must be open for writing to record deletions.
+func MountAll(ctx context.Context, roots *RootResolver, mountPoint string, allowOther bool, snapshot bool) {
+	prepareMountPoint(mountPoint)
+	// The directory is hidden by the mount, it stays reachable by the descriptor opened before.
+	dir, err := os.Open(mountPoint)
+	if err != nil {
+		logger.Fatal("open blocks dir occur error", zap.Error(err))
+	}
+	defer dir.Close()
+	overlay := fmt.Sprintf("/proc/self/fd/%d", dir.Fd())
+	serve(ctx, mountPoint, mountOptions(allowOther), &fuseFs{roots: roots, path: "/", overlay: overlay, snapshot: snapshot})
+}
+
+// prepareMountPoint creates mountPoint, or unmounts a mount left over at it.
+func prepareMountPoint(mountPoint string) {
 	if _, err := os.Stat(mountPoint); err != nil {
 		if os.IsNotExist(err) {
 			err = os.MkdirAll(mountPoint, os.ModePerm)
@@ -35,14 +76,20 @@ func Mount(ctx context.Context, pathPrefix, mountPoint, repoId string, allowOthe
 	if err := fuse.Unmount(mountPoint); err != nil {
 		log.Println("unmount occur error: ", err)
 	}
+}
+
+func mountOptions(allowOther bool) []fuse.MountOption {
 	options := []fuse.MountOption{
 		fuse.FSName("FileMappingFS"),
 		fuse.Subtype("FileMappingFS"),
-		fuse.ReadOnly(),
 	}
 	if allowOther {
 		options = append(options, fuse.AllowOther())
 	}
+	return options
+}
+
+func serve(ctx context.Context, mountPoint string, options []fuse.MountOption, fsys *fuseFs) {
 	mount, err := fuse.Mount(
 		mountPoint,
 		options...,
@@ -55,7 +102,9 @@ func Mount(ctx context.Context, pathPrefix, mountPoint, repoId string, allowOthe
 		<-ctx.Done()
 		_ = mount.Close()
 	}()
-	if err = fs.New(mount, nil).Serve(&fuseFs{pathPrefix: pathPrefix, path: "/" + repoId}); err != nil {
+	fsys.server = fs.New(mount, nil)
+	go serveControl(ctx, fsys)
+	if err = fsys.server.Serve(fsys); err != nil {
 		log.Fatal("serve fs occur error: ", err)
 	}
 }
@@ -0,0 +1,84 @@
+package virtualfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"syscall"
+)
+
+// JournalBucketName is the bucket of the scan journal, it maps the store path of every
+// directory completed by an unfinished scan to its dir object id.
+const JournalBucketName = "JOURNAL"
+
+// ErrJournalMismatch is returned when a scan is resumed with other options than the interrupted scan.
+var ErrJournalMismatch = errors.New("scan options differ from the interrupted scan")
+
+func journalOptionsKey(repoId string) []byte {
+	return []byte("#options/" + repoId)
+}
+
+// StartJournal prepares the journal of repoId for a scan with options.
+// A resumed scan must use the same options as the interrupted one, otherwise the journal is cleared.
+func StartJournal(repoId string, options string, resume bool) error {
+	return update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(JournalBucketName))
+		if bucket == nil {
+			return fmt.Errorf("%s bucket not exist: %w", JournalBucketName, syscall.EIO)
+		}
+		if resume {
+			if old := bucket.Get(journalOptionsKey(repoId)); old != nil && string(old) != options {
+				return ErrJournalMismatch
+			}
+		} else if err := clearJournal(tx, repoId); err != nil {
+			return err
+		}
+		return bucket.Put(journalOptionsKey(repoId), []byte(options))
+	})
+}
+
+// GetCheckpoint returns the dir object id recorded for the directory at path, or an empty id.
+func GetCheckpoint(path string) (dirId string, err error) {
+	err = view(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(JournalBucketName)); bucket != nil {
+			dirId = string(bucket.Get([]byte(path)))
+		}
+		return nil
+	})
+	return
+}
+
+// PutCheckpoint records that the directory at path was completed with the dir object dirId.
+func PutCheckpoint(tx *bbolt.Tx, path string, dirId string) error {
+	bucket := tx.Bucket([]byte(JournalBucketName))
+	if bucket == nil {
+		return fmt.Errorf("%s bucket not exist: %w", JournalBucketName, syscall.EIO)
+	}
+	return bucket.Put([]byte(path), []byte(dirId))
+}
+
+// ClearJournal removes the journal of repoId once its scan is committed.
+func ClearJournal(repoId string) error {
+	return update(func(tx *bbolt.Tx) error {
+		return clearJournal(tx, repoId)
+	})
+}
+
+func clearJournal(tx *bbolt.Tx, repoId string) error {
+	bucket := tx.Bucket([]byte(JournalBucketName))
+	if bucket == nil {
+		return nil
+	}
+	if err := bucket.Delete(journalOptionsKey(repoId)); err != nil {
+		return err
+	}
+	prefix := []byte(repoId)
+	c := bucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Seek(prefix) {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package virtualfs
+
+import (
+	"go.etcd.io/bbolt"
+	"path/filepath"
+)
+
+// Mapper registers scanned files in the block mapping.
+type Mapper interface {
+	// PutFile maps the blocks of the real file at path and records its info.
+	// Random block ids that already exist fail with syscall.EEXIST.
+	PutFile(repoId string, path string, info *RealFileInfo, blockSize int64, kind byte) error
+	// Checkpoint records in the scan journal that the directory at path was completed with the dir object dirId.
+	// It must not become durable before the files mapped ahead of it.
+	Checkpoint(path string, dirId string) error
+	// Flush writes everything buffered by the mapper.
+	Flush() error
+	// View calls fn with a view of the mapping that includes what the mapper buffered.
+	View(fn func(v *MappingView) error) error
+}
+
+// MappingView reads the mapping in a transaction, together with the writes a Mapper has not flushed yet.
+type MappingView struct {
+	tx *bbolt.Tx
+	// pending maps bucket name to key to value, a nil value is a deleted key.
+	pending map[string]map[string][]byte
+}
+
+func (v *MappingView) get(bucket string, key string) []byte {
+	if value, ok := v.pending[bucket][key]; ok {
+		return value
+	}
+	if b := v.tx.Bucket([]byte(bucket)); b != nil {
+		return b.Get([]byte(key))
+	}
+	return nil
+}
+
+func (v *MappingView) proxy(path string) []byte {
+	return v.get(filepath.Dir(path), filepath.Base(path))
+}
+
+// RealFileInfo returns the info recorded by the last scan of path, or nil if the path was never scanned.
+func (v *MappingView) RealFileInfo(path string) (*RealFileInfo, error) {
+	return decodeRealFileInfo([]byte(path), v.get(RealFileInfoBucketName, path))
+}
+
+// ProxyExists checks whether a proxy file exists at path.
+func (v *MappingView) ProxyExists(path string) bool {
+	data := v.proxy(path)
+	return data != nil && data[len(data)-1] != 0
+}
+
+// IsStale checks whether the proxy file at path is in the stale set.
+func (v *MappingView) IsStale(path string) bool {
+	return v.get(StaleBucketName, path) != nil || staleLogged(path)
+}
+
+// ProxyOwner returns the path recorded for the real file the proxy file at path points to, empty if there is none.
+func (v *MappingView) ProxyOwner(path string) string {
+	data := v.proxy(path)
+	if len(data) != 33 || data[32] == 0 {
+		return ""
+	}
+	return string(v.get(IdToRealPathBucketName, string(data[:8])))
+}
+
+// HasChecksum checks whether the SHA-256 of the data of the proxy file at path is recorded.
+func (v *MappingView) HasChecksum(path string) bool {
+	return v.get(ChecksumBucketName, path) != nil
+}
+
+type batchMapper struct {
+}
+
+// NewMapper returns a Mapper that writes every file in its own batched transaction.
+func NewMapper() Mapper {
+	return batchMapper{}
+}
+
+func (batchMapper) PutFile(repoId string, path string, info *RealFileInfo, blockSize int64, kind byte) error {
+	return batch(func(tx *bbolt.Tx) error {
+		return PutFile(tx, repoId, path, info, blockSize, kind)
+	})
+}
+
+func (batchMapper) Checkpoint(path string, dirId string) error {
+	return batch(func(tx *bbolt.Tx) error {
+		return PutCheckpoint(tx, path, dirId)
+	})
+}
+
+func (batchMapper) Flush() error {
+	return nil
+}
+
+func (batchMapper) View(fn func(v *MappingView) error) error {
+	return view(func(tx *bbolt.Tx) error {
+		return fn(&MappingView{tx: tx})
+	})
+}
+
+type nopMapper struct {
+}
+
+// NewNopMapper returns a Mapper that drops everything, for dry runs.
+func NewNopMapper() Mapper {
+	return nopMapper{}
+}
+
+func (nopMapper) PutFile(repoId string, path string, info *RealFileInfo, blockSize int64, kind byte) error {
+	return nil
+}
+
+func (nopMapper) Checkpoint(path string, dirId string) error {
+	return nil
+}
+
+func (nopMapper) Flush() error {
+	return nil
+}
+
+func (nopMapper) View(fn func(v *MappingView) error) error {
+	return view(func(tx *bbolt.Tx) error {
+		return fn(&MappingView{tx: tx})
+	})
+}
+
+// PutFile maps the blocks of the real file at path and records its info in tx.
+func PutFile(tx *bbolt.Tx, repoId string, path string, info *RealFileInfo, blockSize int64, kind byte) error {
+	id, err := PutRealFilePath(tx, []byte(path))
+	if err != nil {
+		return err
+	}
+	old, err := GetRealFileInfo(tx, []byte(path))
+	if err != nil {
+		return err
+	}
+	// The proxies of the previous version point into a file that has changed since, except the content ids
+	// another file with the same content wrote last. They are marked first, so that content ids shared with
+	// the new version are revived below.
+	if old != nil && !old.Unchanged(info) {
+		for _, blkId := range old.BlkIDs {
+			blkPath := ProxyPath(repoId, blkId)
+			if !staleWith(proxyEntry(tx, blkPath), id) {
+				continue
+			}
+			if err = MarkStale(tx, blkPath); err != nil {
+				return err
+			}
+		}
+	}
+	for i, blkId := range info.BlkIDs {
+		offset := int64(i) * blockSize
+		size := min(blockSize, info.Size-offset)
+		if kind == ProxyContent {
+			err = WriteContentProxyFile(tx, ProxyPath(repoId, blkId), id, offset, size, info.Mtime)
+		} else {
+			err = WriteProxyFile(tx, ProxyPath(repoId, blkId), id, offset, size, info.Mtime)
+		}
+		if err != nil {
+			return err
+		}
+		if i < len(info.Sums) {
+			if err = PutChecksum(tx, ProxyPath(repoId, blkId), info.Sums[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return PutRealFileInfo(tx, []byte(path), info)
+}
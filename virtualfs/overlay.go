@@ -0,0 +1,332 @@
+package virtualfs
+
+import (
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+	"context"
+	"errors"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// An overlay mount keeps the files created through the mount in a backing directory, laid out like the mount.
+// An entry of the backing directory hides the mapping entry of the same name, and a mapping entry that is
+// deleted gets a tombstone in the mapping.
+
+// toErrno returns the errno of err for the kernel, FUSE reports other errors as EIO.
+func toErrno(err error) error {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	}
+	return err
+}
+
+// backingPath returns the path of the mount path in the backing directory.
+func (f *fuseFs) backingPath(path string) string {
+	rel, err := filepath.Rel(f.path, path)
+	if err != nil {
+		rel = "."
+	}
+	return filepath.Join(f.overlay, rel)
+}
+
+// inMapping reports whether path is a visible entry of the mapping, and whether it is a directory.
+func inMapping(path string) (isDir bool, ok bool) {
+	var size, offset, mtime int64
+	var fId uint64
+	return isDir, Lookup(path, &isDir, &size, &offset, &fId, &mtime) == nil
+}
+
+// lookupBacking returns the node of path in the backing directory, or nil if there is none.
+func (f *DirNode) lookupBacking(path string) (fs.Node, error) {
+	if f.fs.overlay == "" {
+		return nil, nil
+	}
+	info, err := os.Lstat(f.fs.backingPath(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, toErrno(err)
+	}
+	if info.IsDir() {
+		return &DirNode{path: path, fs: f.fs, mtime: info.ModTime().Unix()}, nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil, nil
+	}
+	return &BackingFileNode{path: path, fs: f.fs}, nil
+}
+
+// readDirBacking adds the entries of the backing directory to the mapping entries of the directory.
+func (f *DirNode) readDirBacking(dirents []fuse.Dirent, err error) ([]fuse.Dirent, error) {
+	if f.fs.overlay == "" {
+		return dirents, err
+	}
+	entries, rErr := os.ReadDir(f.fs.backingPath(f.path))
+	if rErr != nil {
+		if os.IsNotExist(rErr) {
+			return dirents, err
+		}
+		return nil, toErrno(rErr)
+	}
+	// The directory may exist only in the backing directory.
+	if errors.Is(err, syscall.ENOENT) {
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]int, len(dirents))
+	for i, dirent := range dirents {
+		seen[dirent.Name] = i
+	}
+	for _, entry := range entries {
+		dirent := fuse.Dirent{Name: entry.Name(), Type: fuse.DT_File}
+		if entry.IsDir() {
+			dirent.Type = fuse.DT_Dir
+		} else if !entry.Type().IsRegular() {
+			continue
+		}
+		if i, ok := seen[dirent.Name]; ok {
+			dirents[i] = dirent
+		} else {
+			dirents = append(dirents, dirent)
+		}
+	}
+	return dirents, nil
+}
+
+func (f *DirNode) writable() error {
+	if f.fs.overlay == "" {
+		return syscall.EROFS
+	}
+	return nil
+}
+
+func (f *DirNode) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if err := f.writable(); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(f.path, req.Name)
+	logger.Debug("mkdir", zap.String("path", path))
+	if _, ok := inMapping(path); ok {
+		return nil, syscall.EEXIST
+	}
+	if _, err := os.Lstat(f.fs.backingPath(path)); err == nil {
+		return nil, syscall.EEXIST
+	}
+	if err := os.MkdirAll(f.fs.backingPath(path), 0755); err != nil {
+		return nil, toErrno(err)
+	}
+	return &DirNode{path: path, fs: f.fs, mtime: time.Now().Unix()}, nil
+}
+
+func (f *DirNode) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if err := f.writable(); err != nil {
+		return nil, nil, err
+	}
+	path := filepath.Join(f.path, req.Name)
+	logger.Debug("create", zap.String("path", path))
+	if _, ok := inMapping(path); ok && req.Flags&fuse.OpenExclusive != 0 {
+		return nil, nil, syscall.EEXIST
+	}
+	real := f.fs.backingPath(path)
+	if err := os.MkdirAll(filepath.Dir(real), 0755); err != nil {
+		return nil, nil, toErrno(err)
+	}
+	file, err := os.OpenFile(real, backingFlags(req.Flags)|os.O_CREATE, req.Mode.Perm()&^req.Umask.Perm())
+	if err != nil {
+		return nil, nil, toErrno(err)
+	}
+	return &BackingFileNode{path: path, fs: f.fs}, &BackingHandle{f: file}, nil
+}
+
+func (f *DirNode) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	path := filepath.Join(f.path, req.Name)
+	logger.Debug("remove", zap.String("path", path), zap.Bool("dir", req.Dir))
+	isDir, mapped := inMapping(path)
+	if mapped {
+		if isDir != req.Dir {
+			if req.Dir {
+				return syscall.ENOTDIR
+			}
+			return syscall.EISDIR
+		}
+		if isDir {
+			if dirents, err := ListDir(path); err != nil {
+				return err
+			} else if len(dirents) > 0 {
+				return syscall.ENOTEMPTY
+			}
+		}
+	}
+	real := f.fs.backingPath(path)
+	info, err := os.Lstat(real)
+	if err == nil {
+		if info.IsDir() != req.Dir {
+			if req.Dir {
+				return syscall.ENOTDIR
+			}
+			return syscall.EISDIR
+		}
+		if err = os.Remove(real); err != nil {
+			return toErrno(err)
+		}
+	} else if !os.IsNotExist(err) {
+		return toErrno(err)
+	} else if !mapped {
+		return syscall.ENOENT
+	}
+	if !mapped {
+		return nil
+	}
+	// The data of a proxy block belongs to a source root, only the mapping entry is hidden.
+	if err = PutTombstone(path); err != nil {
+		logger.Warn("put tombstone occur error", zap.Error(err), zap.String("path", path))
+		return syscall.EIO
+	}
+	return nil
+}
+
+func (f *DirNode) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if err := f.writable(); err != nil {
+		return err
+	}
+	target, ok := newDir.(*DirNode)
+	if !ok {
+		return syscall.EXDEV
+	}
+	oldPath := filepath.Join(f.path, req.OldName)
+	newPath := filepath.Join(target.path, req.NewName)
+	logger.Debug("rename", zap.String("old_path", oldPath), zap.String("new_path", newPath))
+	_, mapped := inMapping(oldPath)
+	oldReal := f.fs.backingPath(oldPath)
+	if _, err := os.Lstat(oldReal); os.IsNotExist(err) {
+		if mapped {
+			// A proxy block can not be moved into the backing directory, tools fall back to copy and delete.
+			return syscall.EXDEV
+		}
+		return syscall.ENOENT
+	} else if err != nil {
+		return toErrno(err)
+	}
+	newReal := f.fs.backingPath(newPath)
+	if err := os.MkdirAll(filepath.Dir(newReal), 0755); err != nil {
+		return toErrno(err)
+	}
+	if err := os.Rename(oldReal, newReal); err != nil {
+		return toErrno(err)
+	}
+	// Without the backing entry the mapping entry it hid would show again.
+	if mapped {
+		if err := PutTombstone(oldPath); err != nil {
+			logger.Warn("put tombstone occur error", zap.Error(err), zap.String("path", oldPath))
+			return syscall.EIO
+		}
+	}
+	return nil
+}
+
+// backingFlags returns the open flags for a backing file. Writes come with their offset, so O_APPEND is dropped.
+func backingFlags(flags fuse.OpenFlags) int {
+	return int(flags) &^ os.O_APPEND
+}
+
+// BackingFileNode is a file of the backing directory of an overlay mount.
+type BackingFileNode struct {
+	path string
+	fs   *fuseFs
+}
+
+func (f *BackingFileNode) real() string {
+	return f.fs.backingPath(f.path)
+}
+
+func (f *BackingFileNode) Attr(ctx context.Context, attr *fuse.Attr) error {
+	logger.Debug("attr backing file", zap.String("path", f.path))
+	info, err := os.Stat(f.real())
+	if err != nil {
+		return toErrno(err)
+	}
+	attr.Mode = info.Mode().Perm()
+	attr.Size = uint64(info.Size())
+	attr.Mtime = info.ModTime()
+	attr.Ctime = attr.Mtime
+	return nil
+}
+
+func (f *BackingFileNode) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	logger.Debug("open backing file", zap.String("path", f.path))
+	file, err := os.OpenFile(f.real(), backingFlags(req.Flags), 0)
+	if err != nil {
+		return nil, toErrno(err)
+	}
+	return &BackingHandle{f: file}, nil
+}
+
+func (f *BackingFileNode) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	real := f.real()
+	if req.Valid.Size() {
+		if err := os.Truncate(real, int64(req.Size)); err != nil {
+			return toErrno(err)
+		}
+	}
+	if req.Valid.Mode() {
+		if err := os.Chmod(real, req.Mode.Perm()); err != nil {
+			return toErrno(err)
+		}
+	}
+	if req.Valid.Mtime() {
+		if err := os.Chtimes(real, req.Mtime, req.Mtime); err != nil {
+			return toErrno(err)
+		}
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+func (f *BackingFileNode) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	file, err := os.Open(f.real())
+	if err != nil {
+		return toErrno(err)
+	}
+	defer file.Close()
+	return toErrno(file.Sync())
+}
+
+// BackingHandle is an open file of the backing directory.
+type BackingHandle struct {
+	f *os.File
+}
+
+func (h *BackingHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	resp.Data = resp.Data[:req.Size]
+	n, err := h.f.ReadAt(resp.Data, req.Offset)
+	resp.Data = resp.Data[:n]
+	if err == io.EOF {
+		return nil
+	}
+	return toErrno(err)
+}
+
+func (h *BackingHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	n, err := h.f.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	return toErrno(err)
+}
+
+func (h *BackingHandle) Flush(ctx context.Context, req *fuse.FlushRequest) error {
+	return nil
+}
+
+func (h *BackingHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
+	return h.f.Close()
+}
@@ -0,0 +1,161 @@
+package virtualfs
+
+import (
+	"bazil.org/fuse"
+	"context"
+	"errors"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func direntNames(t *testing.T, dir *DirNode) string {
+	dirents, err := dir.ReadDirAll(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, dirent := range dirents {
+		names = append(names, dirent.Name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func TestOverlay(t *testing.T) {
+	ctx := context.Background()
+	if err := InitVirtualFs(filepath.Join(t.TempDir(), "blocks_mapping.db"), false); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	const repoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	proxyPath := ProxyPath(repoId, "ab"+strings.Repeat("1", 38))
+	writeProxy := func() {
+		err := db.Update(func(tx *bbolt.Tx) error {
+			return WriteContentProxyFile(tx, proxyPath, 1, 0, 10, 1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeProxy()
+	overlay := t.TempDir()
+	root := &DirNode{path: "/" + repoId, fs: &fuseFs{path: "/" + repoId, overlay: overlay}}
+	node, err := root.Lookup(ctx, "ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab := node.(*DirNode)
+
+	newName := strings.Repeat("2", 38)
+	_, handle, err := ab.Create(ctx, &fuse.CreateRequest{Name: newName, Flags: fuse.OpenWriteOnly | fuse.OpenExclusive, Mode: 0644}, &fuse.CreateResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := handle.(*BackingHandle)
+	if err = h.Write(ctx, &fuse.WriteRequest{Data: []byte("new block")}, &fuse.WriteResponse{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = h.Release(ctx, &fuse.ReleaseRequest{}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := os.ReadFile(filepath.Join(overlay, "ab", newName)); err != nil || string(data) != "new block" {
+		t.Fatalf("backing file %q, error %v", data, err)
+	}
+	if got, want := direntNames(t, ab), filepath.Base(proxyPath)+","+newName; got != want {
+		t.Errorf("merged dir %s, want %s", got, want)
+	}
+	if node, err = ab.Lookup(ctx, newName); err != nil {
+		t.Fatal(err)
+	} else if _, ok := node.(*BackingFileNode); !ok {
+		t.Errorf("lookup of a backing file returned %T", node)
+	}
+
+	// Deleting a proxy block leaves a tombstone.
+	if err = ab.Remove(ctx, &fuse.RemoveRequest{Name: filepath.Base(proxyPath)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ab.Lookup(ctx, filepath.Base(proxyPath)); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("lookup of a deleted proxy returned %v", err)
+	}
+	if _, err = GetProxy(proxyPath); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("get of a deleted proxy returned %v", err)
+	}
+	if got := direntNames(t, ab); got != newName {
+		t.Errorf("dir after delete %s", got)
+	}
+	// The block is visible again once a scan writes it.
+	writeProxy()
+	if _, err = GetProxy(proxyPath); err != nil {
+		t.Errorf("get of a rescanned proxy returned %v", err)
+	}
+
+	if _, err = root.Mkdir(ctx, &fuse.MkdirRequest{Name: "cd", Mode: os.ModeDir | 0755}); err != nil {
+		t.Fatal(err)
+	}
+	if node, err = root.Lookup(ctx, "cd"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ab.Rename(ctx, &fuse.RenameRequest{OldName: newName, NewName: "moved"}, node); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = os.Stat(filepath.Join(overlay, "cd", "moved")); err != nil {
+		t.Error(err)
+	}
+	if err = ab.Rename(ctx, &fuse.RenameRequest{OldName: filepath.Base(proxyPath), NewName: "x"}, node); !errors.Is(err, syscall.EXDEV) {
+		t.Errorf("rename of a proxy returned %v", err)
+	}
+	if err = root.Remove(ctx, &fuse.RemoveRequest{Name: "cd", Dir: true}); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rmdir of a non-empty dir returned %v", err)
+	}
+
+	readOnly := &DirNode{path: "/" + repoId, fs: &fuseFs{path: "/" + repoId}}
+	if _, err = readOnly.Mkdir(ctx, &fuse.MkdirRequest{Name: "ef"}); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("mkdir without overlay returned %v", err)
+	}
+}
+
+func TestAllRepos(t *testing.T) {
+	ctx := context.Background()
+	if err := InitVirtualFs(filepath.Join(t.TempDir(), "blocks_mapping.db"), false); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	const mapped = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	const native = "22b7f1bd-b9cf-43fb-bd82-78583df3821b"
+	blocks := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(blocks, native, "cd"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root := &DirNode{path: "/", fs: &fuseFs{path: "/", overlay: blocks}}
+	if got := direntNames(t, root); got != native {
+		t.Errorf("blocks dir %s, want %s", got, native)
+	}
+	// A repo scanned while mounted shows up on the next lookup.
+	err := db.Update(func(tx *bbolt.Tx) error {
+		return WriteContentProxyFile(tx, ProxyPath(mapped, "ab"+strings.Repeat("1", 38)), 1, 0, 10, 1)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := direntNames(t, root), mapped+","+native; got != want {
+		t.Errorf("blocks dir %s, want %s", got, want)
+	}
+	node, err := root.Lookup(ctx, mapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := direntNames(t, node.(*DirNode)); got != "ab" {
+		t.Errorf("mapped repo %s, want ab", got)
+	}
+	if node, err = root.Lookup(ctx, native); err != nil {
+		t.Fatal(err)
+	}
+	if got := direntNames(t, node.(*DirNode)); got != "cd" {
+		t.Errorf("native repo %s, want cd", got)
+	}
+}
@@ -0,0 +1,192 @@
+package virtualfs
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// RootsBucketName is the bucket of the named source roots, it maps "<repoId>/<name>" to the absolute path of the root.
+const RootsBucketName = "ROOTS"
+
+// StorePath returns the path under which the real files of the source root name are recorded.
+// The empty name is the root of a scan without names, its files are resolved against the path prefix of the mount.
+func StorePath(repoId string, name string) string {
+	if name == "" {
+		return repoId
+	}
+	return repoId + ":" + name
+}
+
+// SplitStorePath splits a path recorded by a scan into the source root name and the path relative to the root.
+func SplitStorePath(storePath string) (name string, rel string, err error) {
+	if len(storePath) < 36 {
+		return "", "", fmt.Errorf("invalid real path %q: %w", storePath, syscall.EIO)
+	}
+	rel = storePath[36:]
+	if strings.HasPrefix(rel, ":") {
+		name, rel, _ = strings.Cut(rel[1:], "/")
+		rel = "/" + rel
+	}
+	return name, rel, nil
+}
+
+// PutRoot records the absolute path of the source root name of repoId, the empty name is the root of a scan without names.
+func PutRoot(repoId string, name string, path string) error {
+	return update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(RootsBucketName))
+		if bucket == nil {
+			return fmt.Errorf("%s bucket not exist: %w", RootsBucketName, syscall.EIO)
+		}
+		return bucket.Put([]byte(repoId+"/"+name), []byte(path))
+	})
+}
+
+// GetRoots returns the source roots of repoId recorded by scans, by name.
+func GetRoots(repoId string) (roots map[string]string, err error) {
+	roots = make(map[string]string)
+	err = view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(RootsBucketName))
+		if bucket == nil {
+			return nil
+		}
+		prefix := []byte(repoId + "/")
+		c := bucket.Cursor()
+		for k, v := c.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = c.Next() {
+			roots[string(k[len(prefix):])] = string(v)
+		}
+		return nil
+	})
+	return
+}
+
+// LoadRootsConfig reads the source roots from a file of "name=path" lines.
+// Blank lines and lines starting with # are ignored, relative paths are relative to the file.
+func LoadRootsConfig(file string) (map[string]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	roots := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, path, ok := strings.Cut(line, "=")
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("%s:%d: expected name=path", file, n)
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(filepath.Dir(file), path)
+		}
+		roots[name] = path
+	}
+	return roots, scanner.Err()
+}
+
+// RootResolver turns the real file ids of the mapping into paths on the source roots.
+type RootResolver struct {
+	// Prefix is the directory of the root without name. Without Prefix it is taken from the mapping db,
+	// as for the roots of a mount of all repos.
+	Prefix string
+	// Roots are the directories of the named roots, roots missing here are taken from the mapping db.
+	Roots map[string]string
+	// PerRepo keys Roots by the store path of the root, "<repoId>:<name>" or "<repoId>" for the root without
+	// name, as the repos of a mount of all repos may use the same names.
+	PerRepo bool
+}
+
+// NewRootResolver creates a RootResolver.
+func NewRootResolver(prefix string, roots map[string]string) *RootResolver {
+	return &RootResolver{Prefix: prefix, Roots: roots}
+}
+
+// Resolve returns the path of the real file id.
+func (r *RootResolver) Resolve(id uint64) (string, error) {
+	storePath, err := GetRealFilePath(id)
+	if err != nil {
+		return "", err
+	}
+	name, rel, err := SplitStorePath(storePath)
+	if err != nil {
+		return "", err
+	}
+	if rel == "" || rel == "/" {
+		return "", syscall.ENOENT
+	}
+	if name == "" && r.Prefix != "" {
+		return filepath.Join(r.Prefix, rel), nil
+	}
+	// The store path starts with the id of the repo that scanned the file.
+	root, err := r.root(storePath[:36], name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root, rel), nil
+}
+
+func (r *RootResolver) root(repoId string, name string) (string, error) {
+	key := name
+	if r.PerRepo {
+		key = StorePath(repoId, name)
+	}
+	if root, ok := r.Roots[key]; ok {
+		return root, nil
+	}
+	roots, err := GetRoots(repoId)
+	if err != nil {
+		return "", err
+	}
+	if root, ok := roots[name]; ok {
+		return root, nil
+	}
+	return "", fmt.Errorf("source root %q of repo %s is unknown: %w", name, repoId, syscall.ENOENT)
+}
+
+// MissingRoots returns the store paths of the source roots with files in the mapping whose directory is
+// neither given nor recorded, see StorePath. Scans before the mount of all repos did not record the root
+// without name, its repos must be rescanned or have the root given to be mounted without prefix.
+func (r *RootResolver) MissingRoots() (missing []string, err error) {
+	var storeRoots []string
+	err = view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(RealPathToIdBucketName))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, _ := c.First(); k != nil; {
+			storeRoot, _, _ := strings.Cut(string(k), "/")
+			storeRoots = append(storeRoots, storeRoot)
+			// Skip the other files of the root, "0" follows "/".
+			k, _ = c.Seek([]byte(storeRoot + "0"))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, storeRoot := range storeRoots {
+		if len(storeRoot) < 36 {
+			continue
+		}
+		name := strings.TrimPrefix(storeRoot[36:], ":")
+		if name == "" && r.Prefix != "" {
+			continue
+		}
+		if _, err = r.root(storeRoot[:36], name); errors.Is(err, syscall.ENOENT) {
+			missing = append(missing, storeRoot)
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	return missing, nil
+}
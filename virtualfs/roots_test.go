@@ -0,0 +1,121 @@
+package virtualfs
+
+import (
+	"errors"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestRootResolver_Resolve(t *testing.T) {
+	dir := t.TempDir()
+	if err := InitVirtualFs(filepath.Join(dir, "blocks_mapping.db"), false); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	repoId := "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	paths := []string{
+		StorePath(repoId, "") + "/a/old.txt",
+		StorePath(repoId, "disk1") + "/b/one.txt",
+		StorePath(repoId, "disk2") + "/c/two.txt",
+	}
+	ids := make([]uint64, len(paths))
+	err := db.Update(func(tx *bbolt.Tx) (err error) {
+		for i, path := range paths {
+			if ids[i], err = PutRealFilePath(tx, []byte(path)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = PutRoot(repoId, "disk1", "/mnt/disk1"); err != nil {
+		t.Fatal(err)
+	}
+	if err = PutRoot(repoId, "disk2", "/mnt/disk2"); err != nil {
+		t.Fatal(err)
+	}
+	config := filepath.Join(dir, "roots.conf")
+	if err = os.WriteFile(config, []byte("# moved\ndisk2 = /srv/disk2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	roots, err := LoadRootsConfig(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewRootResolver("/data", roots)
+	for i, want := range []string{"/data/a/old.txt", "/mnt/disk1/b/one.txt", "/srv/disk2/c/two.txt"} {
+		got, err := r.Resolve(ids[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("resolve %s = %s, want %s", paths[i], got, want)
+		}
+	}
+	// A mount of all repos has no prefix, the root without name comes from the mapping.
+	if err = PutRoot(repoId, "", "/scan"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := NewRootResolver("", nil).Resolve(ids[0]); err != nil {
+		t.Fatal(err)
+	} else if got != "/scan/a/old.txt" {
+		t.Errorf("resolve %s = %s, want /scan/a/old.txt", paths[0], got)
+	}
+}
+
+func TestRootResolver_PerRepo(t *testing.T) {
+	if err := InitVirtualFs(filepath.Join(t.TempDir(), "blocks_mapping.db"), false); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	const repo1 = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	const repo2 = "22b7f1bd-b9cf-43fb-bd82-78583df3821b"
+	paths := []string{
+		StorePath(repo1, "disk1") + "/a.txt",
+		StorePath(repo2, "disk1") + "/b.txt",
+		StorePath(repo2, "") + "/c.txt",
+		StorePath(repo2, "disk1.old") + "/d.txt",
+	}
+	ids := make([]uint64, len(paths))
+	err := db.Update(func(tx *bbolt.Tx) (err error) {
+		for i, path := range paths {
+			if ids[i], err = PutRealFilePath(tx, []byte(path)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = PutRoot(repo2, "disk1", "/mnt/repo2"); err != nil {
+		t.Fatal(err)
+	}
+	r := &RootResolver{Roots: map[string]string{repo1 + ":disk1": "/mnt/repo1", "disk1": "/mnt/other"}, PerRepo: true}
+	for i, want := range []string{"/mnt/repo1/a.txt", "/mnt/repo2/b.txt"} {
+		if got, err := r.Resolve(ids[i]); err != nil || got != want {
+			t.Errorf("resolve %s = %s, %v, want %s", paths[i], got, err, want)
+		}
+	}
+	// The root without name of repo2 was scanned before it was recorded.
+	if _, err = r.Resolve(ids[2]); !errors.Is(err, syscall.ENOENT) {
+		t.Errorf("resolve of an unknown root returned %v", err)
+	}
+	missing, err := r.MissingRoots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{repo2, repo2 + ":disk1.old"}; strings.Join(missing, ",") != strings.Join(want, ",") {
+		t.Errorf("missing roots %v, want %v", missing, want)
+	}
+	r.Roots[repo2] = "/mnt/plain"
+	if got, err := r.Resolve(ids[2]); err != nil || got != "/mnt/plain/c.txt" {
+		t.Errorf("resolve %s = %s, %v", paths[2], got, err)
+	}
+}
@@ -0,0 +1,320 @@
+package virtualfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/manx98/local_to_seaf_store/logger"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+	"io"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The scrubber of a mount re-reads the proxy files that have a checksum and compares the digest of their data.
+// Its results are kept in the scrub report next to the mapping, a bbolt db of its own: the mapping is often open
+// read-only. The report is opened for each write only, so that scrub status can read it while mounted.
+
+const (
+	// ScrubBucketName maps the proxy files that failed the scrub to their ScrubResult.
+	ScrubBucketName = "SCRUB"
+	// scrubStateBucketName holds the ScrubState.
+	scrubStateBucketName = "SCRUB_STATE"
+	scrubStateKey        = "state"
+)
+
+// Kinds of ScrubResult.
+const (
+	// ScrubCorrupt is a proxy file whose data does not hash to its checksum.
+	ScrubCorrupt = "corrupt"
+	// ScrubUnreadable is a proxy file whose real file could not be read.
+	ScrubUnreadable = "unreadable"
+)
+
+// scrubBatch is the number of proxy files checked between two writes of the report.
+const scrubBatch = 256
+
+// ScrubResult is a proxy file that failed the scrub.
+type ScrubResult struct {
+	Path   string `json:"path"`
+	Kind   string `json:"kind"`
+	Time   int64  `json:"time"`
+	Detail string `json:"detail"`
+}
+
+// ScrubState is the progress of the scrubber.
+type ScrubState struct {
+	// Cursor is the last proxy file checked by the current pass.
+	Cursor      string `json:"cursor"`
+	PassStarted int64  `json:"pass_started"`
+	// Passes counts the completed passes, LastPass is the time the last one completed.
+	Passes   int64 `json:"passes"`
+	LastPass int64 `json:"last_pass"`
+	// Checked and CheckedBytes count the proxy files checked by the current pass.
+	Checked      int64 `json:"checked"`
+	CheckedBytes int64 `json:"checked_bytes"`
+}
+
+// ScrubReportPath returns the path of the scrub report of the mapping at file.
+func ScrubReportPath(file string) string {
+	return file + ".scrub"
+}
+
+// PutChecksum records the SHA-256 of the data of the proxy file at path.
+func PutChecksum(tx *bbolt.Tx, path string, sum []byte) error {
+	bucket := tx.Bucket([]byte(ChecksumBucketName))
+	if bucket == nil {
+		return fmt.Errorf("%s bucket not exist: %w", ChecksumBucketName, syscall.EIO)
+	}
+	return bucket.Put([]byte(path), sum)
+}
+
+// HasChecksum checks whether the SHA-256 of the data of the proxy file at path is recorded.
+func HasChecksum(tx *bbolt.Tx, path string) bool {
+	bucket := tx.Bucket([]byte(ChecksumBucketName))
+	return bucket != nil && bucket.Get([]byte(path)) != nil
+}
+
+type checksum struct {
+	path string
+	sum  []byte
+}
+
+// nextChecksums returns up to n checksums of proxy files after cursor.
+func nextChecksums(cursor string, n int) (sums []checksum, err error) {
+	err = view(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket([]byte(ChecksumBucketName))
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		k, v := c.Seek([]byte(cursor))
+		if k != nil && string(k) == cursor {
+			k, v = c.Next()
+		}
+		for ; k != nil && len(sums) < n; k, v = c.Next() {
+			sums = append(sums, checksum{path: string(k), sum: bytes.Clone(v)})
+		}
+		return nil
+	})
+	return
+}
+
+// Scrubber verifies the proxy files of the mapping against their checksums, one pass after the other.
+type Scrubber struct {
+	Roots *RootResolver
+	// Rate is the number of bytes read per second.
+	Rate int64
+	// Interval is the pause between two passes.
+	Interval time.Duration
+	report   string
+	started  time.Time
+	read     int64
+}
+
+// NewScrubber creates a Scrubber of the open mapping reading at most rate bytes per second.
+// Passes are at least a minute apart.
+func NewScrubber(roots *RootResolver, rate int64, interval time.Duration) *Scrubber {
+	return &Scrubber{Roots: roots, Rate: max(rate, 1), Interval: max(interval, time.Minute), report: ScrubReportPath(dbFile)}
+}
+
+// Run scrubs until ctx is done. A pass continues where the last run stopped.
+func (s *Scrubber) Run(ctx context.Context) {
+	logger.Info("scrubber started", zap.Int64("rate", s.Rate), zap.Duration("interval", s.Interval))
+	state, _, err := ReadScrubReport(s.report)
+	if err != nil {
+		logger.Error("read scrub report occur error", zap.Error(err), zap.String("path", s.report))
+		return
+	}
+	for ctx.Err() == nil {
+		if err = s.step(ctx, state); err != nil {
+			logger.Error("scrub occur error", zap.Error(err))
+			sleep(ctx, time.Minute)
+			continue
+		}
+		if state.Cursor != "" {
+			continue
+		}
+		logger.Info("scrub pass completed", zap.Int64("checked", state.Checked), zap.Int64("bytes", state.CheckedBytes))
+		sleep(ctx, s.Interval)
+	}
+}
+
+// step checks the next batch of proxy files and writes the results, the pass is complete if the cursor is reset.
+func (s *Scrubber) step(ctx context.Context, state *ScrubState) error {
+	if state.Cursor == "" {
+		state.PassStarted, state.Checked, state.CheckedBytes = time.Now().Unix(), 0, 0
+	}
+	sums, err := nextChecksums(state.Cursor, scrubBatch)
+	if err != nil {
+		return err
+	}
+	if len(sums) == 0 {
+		state.Cursor = ""
+		state.Passes++
+		state.LastPass = time.Now().Unix()
+		return s.write(state, nil, nil)
+	}
+	s.started, s.read = time.Now(), 0
+	var failed []*ScrubResult
+	var passed []string
+	for _, c := range sums {
+		if ctx.Err() != nil {
+			break
+		}
+		result, n, skip := s.check(c)
+		state.Cursor = c.path
+		state.Checked++
+		state.CheckedBytes += n
+		if result != nil {
+			failed = append(failed, result)
+		} else if !skip {
+			passed = append(passed, c.path)
+		}
+		s.throttle(ctx, n)
+	}
+	return s.write(state, failed, passed)
+}
+
+// check verifies the proxy file of c. It returns nil if the data matches, and whether the proxy file was skipped:
+// it no longer exists or is already stale.
+func (s *Scrubber) check(c checksum) (result *ScrubResult, n int64, skip bool) {
+	proxy, err := GetProxy(c.path)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil, 0, true
+	}
+	fail := func(kind string, err error) (*ScrubResult, int64, bool) {
+		logger.Error("scrub found a bad proxy file", zap.String("path", c.path), zap.String("kind", kind), zap.Error(err))
+		return &ScrubResult{Path: c.path, Kind: kind, Time: time.Now().Unix(), Detail: err.Error()}, n, false
+	}
+	if err != nil {
+		return fail(ScrubUnreadable, err)
+	}
+	if proxy.Stale {
+		return nil, 0, true
+	}
+	realPath, err := s.Roots.Resolve(proxy.RealFileId)
+	if err != nil {
+		return fail(ScrubUnreadable, fmt.Errorf("resolve real file %d: %w", proxy.RealFileId, err))
+	}
+	f, err := os.Open(realPath)
+	if err != nil {
+		return fail(ScrubUnreadable, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err = io.Copy(h, io.NewSectionReader(f, proxy.Offset, proxy.Size))
+	if err == nil && n != proxy.Size {
+		err = fmt.Errorf("%s has %d bytes at %d, want %d: %w", realPath, n, proxy.Offset, proxy.Size, io.ErrUnexpectedEOF)
+	}
+	if err != nil {
+		return fail(ScrubUnreadable, err)
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, c.sum) {
+		// The data is not served any more, reads of the proxy file fail like those of a changed real file.
+		if mErr := markStale(c.path); mErr != nil {
+			logger.Warn("mark proxy file stale occur error", zap.String("path", c.path), zap.Error(mErr))
+		}
+		return fail(ScrubCorrupt, fmt.Errorf("%s at %d hashes to %s, want %s", realPath, proxy.Offset, hex.EncodeToString(sum), hex.EncodeToString(c.sum)))
+	}
+	return nil, n, false
+}
+
+// throttle waits until the bytes read in the step are within the rate.
+func (s *Scrubber) throttle(ctx context.Context, n int64) {
+	s.read += n
+	due := s.started.Add(time.Duration(float64(s.read) / float64(s.Rate) * float64(time.Second)))
+	sleep(ctx, time.Until(due))
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
+
+// write records the state, the failed proxy files and drops the results of the proxy files that passed.
+func (s *Scrubber) write(state *ScrubState, failed []*ScrubResult, passed []string) error {
+	report, err := bbolt.Open(s.report, 0644, &bbolt.Options{Timeout: lockTimeout})
+	if err != nil {
+		return fmt.Errorf("open scrub report: %w", err)
+	}
+	defer report.Close()
+	return report.Update(func(tx *bbolt.Tx) error {
+		results, err := tx.CreateBucketIfNotExists([]byte(ScrubBucketName))
+		if err != nil {
+			return err
+		}
+		for _, path := range passed {
+			if err = results.Delete([]byte(path)); err != nil {
+				return err
+			}
+		}
+		for _, result := range failed {
+			data, err := json.Marshal(result)
+			if err != nil {
+				return err
+			}
+			if err = results.Put([]byte(result.Path), data); err != nil {
+				return err
+			}
+		}
+		stateBucket, err := tx.CreateBucketIfNotExists([]byte(scrubStateBucketName))
+		if err != nil {
+			return err
+		}
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return stateBucket.Put([]byte(scrubStateKey), data)
+	})
+}
+
+// ReadScrubReport returns the state of the scrubber and the proxy files that failed the scrub, sorted by path.
+// A missing report is empty.
+func ReadScrubReport(file string) (state *ScrubState, results []*ScrubResult, err error) {
+	state = &ScrubState{}
+	if _, err = os.Stat(file); os.IsNotExist(err) {
+		return state, nil, nil
+	}
+	report, err := bbolt.Open(file, 0644, &bbolt.Options{ReadOnly: true, Timeout: lockTimeout})
+	if err != nil {
+		return nil, nil, fmt.Errorf("open scrub report: %w", err)
+	}
+	defer report.Close()
+	err = report.View(func(tx *bbolt.Tx) error {
+		if bucket := tx.Bucket([]byte(scrubStateBucketName)); bucket != nil {
+			if data := bucket.Get([]byte(scrubStateKey)); data != nil {
+				if err := json.Unmarshal(data, state); err != nil {
+					return fmt.Errorf("decode scrub state: %w", err)
+				}
+			}
+		}
+		bucket := tx.Bucket([]byte(ScrubBucketName))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			result := &ScrubResult{}
+			if err := json.Unmarshal(v, result); err != nil {
+				return fmt.Errorf("decode scrub result of %s: %w", k, err)
+			}
+			results = append(results, result)
+			return nil
+		})
+	})
+	return
+}
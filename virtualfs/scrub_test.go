@@ -0,0 +1,89 @@
+package virtualfs
+
+import (
+	"context"
+	"crypto/sha256"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScrubber(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	if err := InitVirtualFs(filepath.Join(dir, "blocks_mapping.db"), false); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	const repoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	source := filepath.Join(dir, "a.txt")
+	data := []byte("0123456789abcdefghij")
+	if err := os.WriteFile(source, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := NewRealFileInfo(stat)
+	info.FileID = strings.Repeat("f", 40)
+	info.BlkIDs = []string{"ab" + strings.Repeat("1", 38), "ab" + strings.Repeat("2", 38)}
+	for i := 0; i < 2; i++ {
+		sum := sha256.Sum256(data[i*10 : i*10+10])
+		info.Sums = append(info.Sums, sum[:])
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return PutFile(tx, repoId, StorePath(repoId, "")+"/a.txt", info, 10, ProxyRandom)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewScrubber(NewRootResolver(dir, nil), 1<<30, time.Hour)
+	state := &ScrubState{}
+	pass := func() []*ScrubResult {
+		for {
+			if err := s.step(ctx, state); err != nil {
+				t.Fatal(err)
+			}
+			if state.Cursor == "" {
+				break
+			}
+		}
+		_, results, err := ReadScrubReport(s.report)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+	if results := pass(); len(results) != 0 {
+		t.Fatalf("scrub of intact file found %+v", results)
+	}
+	// Bit rot in the second block, the metadata is unchanged.
+	data[15] ^= 1
+	if err = os.WriteFile(source, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(source, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	results := pass()
+	if len(results) != 1 || results[0].Kind != ScrubCorrupt || results[0].Path != ProxyPath(repoId, info.BlkIDs[1]) {
+		t.Fatalf("scrub of rotten file found %+v, want the second block corrupt", results)
+	}
+	proxy, err := GetProxy(results[0].Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proxy.Stale {
+		t.Error("corrupt proxy is not stale")
+	}
+	if state, _, err = ReadScrubReport(s.report); err != nil {
+		t.Fatal(err)
+	}
+	if state.Passes != 2 || state.Checked != 2 {
+		t.Errorf("state %+v, want 2 passes of 2 blocks", state)
+	}
+}
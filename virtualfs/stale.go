@@ -0,0 +1,117 @@
+package virtualfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"go.etcd.io/bbolt"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// A read-only mount can not write the stale set of the mapping, the proxy files it finds stale are appended
+// to the stale log next to the mapping. The log counts as part of the stale set, and the next process that
+// opens the mapping for writing moves it into the stale bucket.
+
+var staleLogLock sync.Mutex
+
+// staleLog holds the paths of the stale log.
+var staleLog map[string]bool
+
+// StaleLogPath returns the path of the stale log of the mapping at file.
+func StaleLogPath(file string) string {
+	return file + ".stale"
+}
+
+// loadStaleLog reads the stale log of the mapping, and moves it into the stale bucket if the mapping is writable.
+func loadStaleLog() error {
+	staleLogLock.Lock()
+	defer staleLogLock.Unlock()
+	staleLog = make(map[string]bool)
+	f, err := os.Open(StaleLogPath(dbFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("open stale log: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if path := strings.TrimSpace(scanner.Text()); path != "" {
+			staleLog[path] = true
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("read stale log: %w", err)
+	}
+	if dbReadOnly {
+		return nil
+	}
+	err = batch(func(tx *bbolt.Tx) error {
+		for path := range staleLog {
+			if mErr := MarkStale(tx, path); mErr != nil {
+				return mErr
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("move stale log into %s bucket: %w", StaleBucketName, err)
+	}
+	staleLog = make(map[string]bool)
+	return os.Remove(StaleLogPath(dbFile))
+}
+
+func staleLogged(path string) bool {
+	staleLogLock.Lock()
+	defer staleLogLock.Unlock()
+	return staleLog[path]
+}
+
+// markStale adds the proxy file at path to the stale set, through the stale log if the mapping is read-only.
+func markStale(path string) error {
+	err := batch(func(tx *bbolt.Tx) error {
+		return MarkStale(tx, path)
+	})
+	if !errors.Is(err, bbolt.ErrDatabaseReadOnly) {
+		return err
+	}
+	staleLogLock.Lock()
+	defer staleLogLock.Unlock()
+	if staleLog[path] {
+		return nil
+	}
+	f, err := os.OpenFile(StaleLogPath(dbFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open stale log: %w", err)
+	}
+	defer f.Close()
+	if _, err = fmt.Fprintln(f, path); err != nil {
+		return fmt.Errorf("write stale log: %w", err)
+	}
+	staleLog[path] = true
+	return nil
+}
+
+// proxyState returns whether the proxy file at path is stale, and the info recorded by the last scan of its
+// real file id, nil if there is none.
+func proxyState(path string, id uint64) (stale bool, info *RealFileInfo, err error) {
+	err = view(func(tx *bbolt.Tx) error {
+		stale = IsStale(tx, path)
+		bucket := tx.Bucket([]byte(IdToRealPathBucketName))
+		if bucket == nil {
+			return syscall.EIO
+		}
+		realPath := bucket.Get(binary.BigEndian.AppendUint64([]byte{}, id))
+		if realPath == nil {
+			return nil
+		}
+		var iErr error
+		info, iErr = GetRealFileInfo(tx, realPath)
+		return iErr
+	})
+	return
+}
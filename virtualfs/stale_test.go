@@ -0,0 +1,130 @@
+package virtualfs
+
+import (
+	"bazil.org/fuse"
+	"context"
+	"errors"
+	"go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRealFileInfoEncoding(t *testing.T) {
+	info := &RealFileInfo{Size: 10, Mtime: 1, FileID: strings.Repeat("a", 40), BlkIDs: []string{strings.Repeat("b", 40)}}
+	for _, ino := range []uint64{0, 42} {
+		info.Ino, info.Ctime = ino, int64(ino)
+		data, err := encodeRealFileInfo(info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeRealFileInfo(nil, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Ino != ino || got.Ctime != int64(ino) || len(got.BlkIDs) != 1 || got.BlkIDs[0] != info.BlkIDs[0] {
+			t.Errorf("decoded %+v, want %+v", got, info)
+		}
+	}
+}
+
+func TestOpenChangedFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "blocks_mapping.db")
+	if err := InitVirtualFs(file, false); err != nil {
+		t.Fatal(err)
+	}
+	defer Close()
+	const repoId = "11a6e0ac-a8be-42ea-ac71-67472ce2710a"
+	source := filepath.Join(dir, "a.txt")
+	if err := os.WriteFile(source, []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	stat, err := os.Stat(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := NewRealFileInfo(stat)
+	info.FileID = strings.Repeat("f", 40)
+	info.BlkIDs = []string{"ab" + strings.Repeat("1", 38)}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return PutFile(tx, repoId, StorePath(repoId, "")+"/a.txt", info, 10, ProxyRandom)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := &DirNode{path: "/" + repoId, fs: &fuseFs{path: "/" + repoId, roots: NewRootResolver(dir, nil)}}
+	open := func() error {
+		node, err := root.Lookup(ctx, "ab")
+		if err == nil {
+			node, err = node.(*DirNode).Lookup(ctx, strings.Repeat("1", 38))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		handle, err := node.(*FileNode).Open(ctx, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+		if err == nil {
+			err = handle.(*FileHandle).Release(ctx, &fuse.ReleaseRequest{})
+		}
+		return err
+	}
+	if err = open(); err != nil {
+		t.Fatal(err)
+	}
+	// The same size and mtime after an in-place rewrite, only the ctime tells.
+	time.Sleep(1100 * time.Millisecond)
+	if err = os.WriteFile(source, []byte("9876543210"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Chtimes(source, stat.ModTime(), stat.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	if err = open(); !errors.Is(err, syscall.EIO) {
+		t.Fatalf("open changed file returned %v, want EIO", err)
+	}
+	proxy, err := GetProxy(ProxyPath(repoId, info.BlkIDs[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proxy.Stale {
+		t.Error("proxy of changed file is not stale")
+	}
+}
+
+func TestStaleLog(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocks_mapping.db")
+	if err := InitVirtualFs(file, false); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	if err := InitVirtualFs(file, true); err != nil {
+		t.Fatal(err)
+	}
+	const path = "/11a6e0ac-a8be-42ea-ac71-67472ce2710a/ab/cd"
+	if err := markStale(path); err != nil {
+		t.Fatal(err)
+	}
+	Close()
+	// A read-only process sees the log, a writable one moves it into the mapping.
+	for _, readOnly := range []bool{true, false, true} {
+		if err := InitVirtualFs(file, readOnly); err != nil {
+			t.Fatal(err)
+		}
+		var stale bool
+		_ = View(func(tx *bbolt.Tx) error {
+			stale = IsStale(tx, path)
+			return nil
+		})
+		Close()
+		if !stale {
+			t.Errorf("path not stale with readOnly %v", readOnly)
+		}
+	}
+	if _, err := os.Stat(StaleLogPath(file)); !os.IsNotExist(err) {
+		t.Errorf("stale log left after writable open: %v", err)
+	}
+}
@@ -0,0 +1,14 @@
+package virtualfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the inode and ctime of info, or zeros if they are not known.
+func fileIdentity(info os.FileInfo) (ino uint64, ctime int64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return st.Ino, st.Ctim.Sec
+	}
+	return 0, 0
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+
+package virtualfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileIdentity returns the inode of info, the ctime is only recorded on linux.
+func fileIdentity(info os.FileInfo) (ino uint64, ctime int64) {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Ino), 0
+	}
+	return 0, 0
+}